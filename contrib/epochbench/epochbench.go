@@ -0,0 +1,138 @@
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "log"
+  "net"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "P3-f12/official/lsp12"
+)
+
+/**
+ * Epoch benchmark.
+ * Opens a server holding N idle connections alongside one active client,
+ * and measures echo round trips on the active client across many epochs.
+ * If epoch processing grew with N, the server loop would stall once per
+ * epoch and the tail latency would grow with it.
+ * A server holds at most 65535 connections, the size of the ID space.
+ */
+
+// Open idle connections by sending raw connection requests, each from its
+// own loopback address & port.  The sockets are closed again once the
+// server has acknowledged, so the connections stay silent from then on.
+func openIdle(port, n int) {
+  pkt, _ := json.Marshal(lsp12.GenConnectMessage())
+  raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+  var buffer [1500]byte
+
+  for i := 0; i < n; i++ {
+    laddr := &net.UDPAddr{IP: net.IPv4(127, 1, byte(i >> 8), byte(i))}
+    con, err := net.DialUDP("udp", laddr, raddr)
+    if err != nil {
+      log.Fatalln("net.DialUDP() error:", err.Error())
+    }
+
+    for tries := 0; tries < 5; tries++ {
+      con.Write(pkt)
+      con.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+      if _, err = con.Read(buffer[0:]); err == nil {
+        break
+      }
+    }
+    con.Close()
+  }
+}
+
+// Echo everything back to sender
+func echo(srv *lsp12.LspServer) {
+  for {
+    id, payload, err := srv.Read()
+    if err != nil {
+      if id == 0 {
+        return
+      }
+      continue
+    }
+    srv.Write(id, payload)
+  }
+}
+
+func run(port, n, ms int, d time.Duration) {
+  // Idle connections must outlive the measurement
+  params := &lsp12.LspParams{EpochLimit: 1 << 20, EpochMilliseconds: ms}
+
+  srv, err := lsp12.NewLspServer(port, params)
+  if err != nil {
+    log.Fatalln("lsp12.NewLspServer() error:", err.Error())
+  }
+  go echo(srv)
+
+  t0 := time.Now()
+  openIdle(port, n)
+  setup := time.Since(t0)
+
+  cli, err := lsp12.NewLspClient(fmt.Sprintf("localhost:%d", port), params)
+  if err != nil {
+    log.Fatalln("lsp12.NewLspClient() error:", err.Error())
+  }
+
+  var lat []time.Duration
+  payload := []byte("ping")
+  t0 = time.Now()
+  for time.Since(t0) < d {
+    t := time.Now()
+    cli.Write(payload)
+    if _, err = cli.Read(); err != nil {
+      log.Fatalln("Read() error:", err.Error())
+    }
+    lat = append(lat, time.Since(t))
+  }
+
+  sort.Sort(byDuration(lat))
+  var sum time.Duration
+  for _, l := range lat {
+    sum += l
+  }
+  fmt.Printf("%8d %10v %8d %10v %10v %10v\n", n, setup.Round(time.Millisecond),
+      len(lat), sum / time.Duration(len(lat)),
+      lat[len(lat) * 99 / 100], lat[len(lat) - 1])
+
+  cli.Close()
+  srv.CloseAll()
+}
+
+type byDuration []time.Duration
+
+func (a byDuration) Len() int           { return len(a) }
+func (a byDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDuration) Less(i, j int) bool { return a[i] < a[j] }
+
+func main() {
+  var ihelp *bool = flag.Bool("h", false, "Print help information")
+  var iport *int = flag.Int("p", 56000, "First port number")
+  var counts *string = flag.String("n", "0,1000,10000,60000", "Idle connection counts")
+  var ms *int = flag.Int("e", 20, "Epoch length in milliseconds")
+  var secs *int = flag.Int("d", 5, "Seconds of round trips per count")
+
+  flag.Parse()
+  if *ihelp {
+    flag.Usage()
+    os.Exit(0)
+  }
+
+  fmt.Printf("%8s %10s %8s %10s %10s %10s\n",
+      "idle", "setup", "trips", "mean", "p99", "max")
+  for i, s := range strings.Split(*counts, ",") {
+    n, err := strconv.Atoi(s)
+    if err != nil {
+      log.Fatalln("Invalid count:", s)
+    }
+    run(*iport + i, n, *ms, time.Duration(*secs) * time.Second)
+  }
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+  "bytes"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "P3-f12/official/lsp12"
+  "P3-f12/official/lspnet"
+)
+
+/**
+ * Loss benchmark.
+ * Measures echo round trips over loopback UDP while lspnet drops a
+ * share of the packets written, with forward error correction off and
+ * with various stripe counts.  Without FEC, every lost message or
+ * acknowledgement costs an epoch before it is sent again.
+ * Resent and rebuilt counts come from the server's view of the
+ * connection: messages it sent again, and messages from the client it
+ * rebuilt from parity.
+ */
+
+// Echo everything back to sender
+func echo(srv *lsp12.LspServer) {
+  for {
+    id, payload, err := srv.Read()
+    if err != nil {
+      if id == 0 {
+        return
+      }
+      continue
+    }
+    srv.Write(id, payload)
+  }
+}
+
+func run(port, drop, stripes, ms, trips, size int) {
+  params := &lsp12.LspParams{EpochLimit: 50, EpochMilliseconds: ms, FECStripes: stripes}
+
+  srv, err := lsp12.NewLspServer(port, params)
+  if err != nil {
+    log.Fatalln("lsp12.NewLspServer() error:", err.Error())
+  }
+  go echo(srv)
+
+  cli, err := lsp12.NewLspClient(fmt.Sprintf("localhost:%d", port), params)
+  if err != nil {
+    log.Fatalln("lsp12.NewLspClient() error:", err.Error())
+  }
+
+  lspnet.SetWriteDropPercent(drop)
+  var lat []time.Duration
+  payload := bytes.Repeat([]byte("x"), size)
+  for i := 0; i < trips; i++ {
+    t := time.Now()
+    cli.Write(payload)
+    if _, err = cli.Read(); err != nil {
+      log.Fatalln("Read() error:", err.Error())
+    }
+    lat = append(lat, time.Since(t))
+  }
+  lspnet.SetWriteDropPercent(0)
+
+  sort.Sort(byDuration(lat))
+  var sum time.Duration
+  for _, l := range lat {
+    sum += l
+  }
+  conns := srv.Connections()
+  var resent, rebuilt int
+  if len(conns) > 0 {
+    resent, rebuilt = conns[0].Resent, conns[0].Rebuilt
+  }
+  fmt.Printf("%6d%% %8d %10v %10v %10v %8d %8d\n", drop, stripes,
+      (sum / time.Duration(len(lat))).Round(time.Microsecond),
+      lat[len(lat) * 99 / 100].Round(time.Microsecond),
+      lat[len(lat) - 1].Round(time.Microsecond), resent, rebuilt)
+
+  cli.Close()
+  srv.CloseAll()
+}
+
+type byDuration []time.Duration
+
+func (a byDuration) Len() int           { return len(a) }
+func (a byDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDuration) Less(i, j int) bool { return a[i] < a[j] }
+
+// Parse comma-separated list of integers
+func ints(list string) []int {
+  var v []int
+  for _, s := range strings.Split(list, ",") {
+    n, err := strconv.Atoi(s)
+    if err != nil {
+      log.Fatalln("Invalid number:", s)
+    }
+    v = append(v, n)
+  }
+  return v
+}
+
+func main() {
+  var ihelp *bool = flag.Bool("h", false, "Print help information")
+  var iport *int = flag.Int("p", 57000, "First port number")
+  var drops *string = flag.String("l", "0,5,10,20", "Write drop percentages")
+  var stripes *string = flag.String("k", "0,2,4,8", "FEC stripe counts (0 for none)")
+  var ms *int = flag.Int("e", 50, "Epoch length in milliseconds")
+  var trips *int = flag.Int("n", 500, "Round trips per run")
+  var size *int = flag.Int("s", 200, "Payload size in bytes")
+
+  flag.Parse()
+  if *ihelp {
+    flag.Usage()
+    os.Exit(0)
+  }
+
+  fmt.Printf("%7s %8s %10s %10s %10s %8s %8s\n",
+      "drop", "stripes", "mean", "p99", "max", "resent", "rebuilt")
+  port := *iport
+  for _, d := range ints(*drops) {
+    for _, k := range ints(*stripes) {
+      run(port, d, k, *ms, *trips, *size)
+      port++
+    }
+  }
+}
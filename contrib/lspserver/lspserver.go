@@ -0,0 +1,121 @@
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "log"
+  "net/http"
+  "os"
+  "os/signal"
+  "syscall"
+  "P3-f12/official/lsp12"
+  "P3-f12/official/lsplog"
+)
+
+/**
+ * LSP echo server.
+ * Parameters come from a JSON config file holding LspParams fields, e.g.
+ *   {"EpochLimit": 5, "EpochMilliseconds": 2000, "MessageTTL": 10}
+ * Send SIGHUP to reload the file.  The new parameters are applied to the
+ * running server without dropping connections.
+ * With -a, serves a snapshot of connections as JSON at /connections,
+ * and server counts at /stats.
+ */
+
+// Read parameters from config file.  Fields left out keep their defaults
+func loadParams(path string) (*lsp12.LspParams, error) {
+  params := &lsp12.LspParams{EpochLimit: 5, EpochMilliseconds: 2000}
+  if path == "" {
+    return params, nil
+  }
+
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  if err = json.Unmarshal(data, params); err != nil {
+    return nil, err
+  }
+  return params, nil
+}
+
+// Reload config on every SIGHUP.  A bad file leaves parameters as they were
+func reload(srv *lsp12.LspServer, path string) {
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+
+  for range hup {
+    params, err := loadParams(path)
+    if err == nil {
+      err = srv.SetParams(params)
+    }
+    if err != nil {
+      log.Println("Reload failed:", err.Error())
+      continue
+    }
+    log.Printf("Reloaded %s: %+v\n", path, *params)
+  }
+}
+
+// Write v as indented JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  enc := json.NewEncoder(w)
+  enc.SetIndent("", "  ")
+  enc.Encode(v)
+}
+
+// Admin pages listing connections and server counts
+func admin(srv *lsp12.LspServer, addr string) {
+  http.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, srv.Connections())
+  })
+  http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, srv.Stats())
+  })
+  log.Fatalln(http.ListenAndServe(addr, nil))
+}
+
+func main() {
+  var ihelp *bool = flag.Bool("h", false, "Print help information")
+  var iport *int = flag.Int("p", 6666, "Port number")
+  var config *string = flag.String("c", "", "Config file, reloaded on SIGHUP")
+  var verb *int = flag.Int("v", 1, "Verbosity (0-6)")
+  var adminAddr *string = flag.String("a", "", "Address for admin page, e.g. :8080")
+
+  flag.Parse()
+  if *ihelp {
+    flag.Usage()
+    os.Exit(0)
+  }
+  lsplog.SetVerbose(*verb)
+
+  params, err := loadParams(*config)
+  if err != nil {
+    log.Fatalln("Config error:", err.Error())
+  }
+
+  srv, err := lsp12.NewLspServer(*iport, params)
+  if err != nil {
+    log.Fatalln("lsp12.NewLspServer() error:", err.Error())
+  }
+  if *config != "" {
+    go reload(srv, *config)
+  }
+  if *adminAddr != "" {
+    go admin(srv, *adminAddr)
+  }
+  log.Printf("Echo server listening on %v\n", srv.LocalAddr())
+
+  for {
+    id, payload, err := srv.Read()
+    if err != nil {
+      if id == 0 {
+        return
+      }
+      log.Println(err.Error())
+      continue
+    }
+    srv.Write(id, payload)
+  }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "runtime"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+  "P3-f12/official/lsp12"
+)
+
+/**
+ * Shard benchmark.
+ * Runs echo round trips from many clients at once, over loopback UDP,
+ * against servers with various numbers of shards, and reports total
+ * round trips per second.  With one shard, a single event loop handles
+ * every connection and the server tops out at one core.  Throughput
+ * should grow with the shard count until GOMAXPROCS is reached.
+ * Clients run in the same process, so they share the cores with the
+ * server; the speedup shown is a lower bound.
+ */
+
+// Echo everything back to sender
+func echo(srv *lsp12.LspServer) {
+  for {
+    id, payload, err := srv.Read()
+    if err != nil {
+      if id == 0 {
+        return
+      }
+      continue
+    }
+    srv.Write(id, payload)
+    lsp12.ReleasePayload(payload)
+  }
+}
+
+// Returns round trips per second
+func run(port, shards, clients, size int, d time.Duration) float64 {
+  params := &lsp12.LspParams{EpochLimit: 50, EpochMilliseconds: 200,
+    ServerShards: shards, NoDelay: true}
+
+  srv, err := lsp12.NewLspServer(port, params)
+  if err != nil {
+    log.Fatalln("lsp12.NewLspServer() error:", err.Error())
+  }
+  readers := runtime.GOMAXPROCS(0)
+  for i := 0; i < readers; i++ {
+    go echo(srv)
+  }
+
+  var clis []*lsp12.LspClient
+  for i := 0; i < clients; i++ {
+    cli, err := lsp12.NewLspClient(fmt.Sprintf("localhost:%d", port), params)
+    if err != nil {
+      log.Fatalln("lsp12.NewLspClient() error:", err.Error())
+    }
+    clis = append(clis, cli)
+  }
+
+  var trips atomic.Int64
+  var wg sync.WaitGroup
+  payload := make([]byte, size)
+  t0 := time.Now()
+  for _, cli := range clis {
+    wg.Add(1)
+    go func(cli *lsp12.LspClient) {
+      defer wg.Done()
+      for time.Since(t0) < d {
+        cli.Write(payload)
+        b, err := cli.Read()
+        if err != nil {
+          log.Fatalln("Read() error:", err.Error())
+        }
+        lsp12.ReleasePayload(b)
+        trips.Add(1)
+      }
+    }(cli)
+  }
+  wg.Wait()
+  rate := float64(trips.Load()) / time.Since(t0).Seconds()
+
+  for _, cli := range clis {
+    cli.Close()
+  }
+  srv.CloseAll()
+  return rate
+}
+
+func main() {
+  var ihelp *bool = flag.Bool("h", false, "Print help information")
+  var iport *int = flag.Int("p", 58000, "First port number")
+  var shards *string = flag.String("k", "1,2,4,8", "Shard counts")
+  var clients *int = flag.Int("c", 64, "Concurrent clients")
+  var size *int = flag.Int("s", 100, "Payload size in bytes")
+  var secs *int = flag.Int("d", 5, "Seconds of round trips per shard count")
+
+  flag.Parse()
+  if *ihelp {
+    flag.Usage()
+    os.Exit(0)
+  }
+
+  fmt.Printf("GOMAXPROCS %d, %d clients\n", runtime.GOMAXPROCS(0), *clients)
+  fmt.Printf("%8s %12s %8s\n", "shards", "trips/s", "speedup")
+  var base float64
+  for i, s := range strings.Split(*shards, ",") {
+    k, err := strconv.Atoi(s)
+    if err != nil || k < 1 {
+      log.Fatalln("Invalid shard count:", s)
+    }
+    rate := run(*iport + i, k, *clients, *size, time.Duration(*secs) * time.Second)
+    if i == 0 {
+      base = rate
+    }
+    fmt.Printf("%8d %12.0f %8.2f\n", k, rate, rate / base)
+  }
+}
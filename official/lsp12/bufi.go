@@ -1,51 +1,137 @@
-// Unbounded buffer, where underlying values are arbitrary values
+// Queue of values of a single type, stored in a ring buffer that grows
+// as needed.  Optionally bounded, in which case insertions fail once
+// the queue holds its capacity
 package lsp12
 
-// Linked list element
-type BufEle struct {
-	val interface{}
-	next *BufEle
+import (
+	"iter"
+)
+
+type Queue[T any] struct {
+	vals []T  // Ring storage.  Length is zero or a power of two
+	head int  // Index of oldest element
+	n int     // Number of elements
+	limit int // Maximum number of elements.  0 means unbounded
+}
+
+// Create queue holding at most limit values.  When limit is 0, the
+// queue is unbounded
+func NewQueue[T any](limit int) *Queue[T] {
+	return &Queue[T]{limit: limit}
+}
+
+// Add value at tail.  Returns false, leaving queue unchanged, if full
+func (q *Queue[T]) Insert(val T) bool {
+	if q.limit > 0 && q.n >= q.limit {
+		return false
+	}
+	if q.n == len(q.vals) {
+		q.grow()
+	}
+	q.vals[(q.head + q.n) & (len(q.vals) - 1)] = val
+	q.n++
+	return true
+}
+
+// Oldest value, or zero value if empty
+func (q *Queue[T]) Front() T {
+	var zero T
+	if q.n == 0 { return zero }
+	return q.vals[q.head]
+}
+
+// Remove and return oldest value, or zero value if empty
+func (q *Queue[T]) Remove() T {
+	var zero T
+	if q.n == 0 { return zero }
+	v := q.vals[q.head]
+	// Don't keep reference to removed value
+	q.vals[q.head] = zero
+	q.head = (q.head + 1) & (len(q.vals) - 1)
+	q.n--
+	return v
 }
 
-type Buf struct {
-	head *BufEle         // Oldest element
-	tail *BufEle         // Most recently inserted element
+func (q *Queue[T]) Empty() bool {
+	return q.n == 0
 }
 
-func NewBuf() *Buf {
-	return new(Buf)
+// Number of values in queue
+func (q *Queue[T]) Len() int {
+	return q.n
 }
 
-func (bp *Buf) Insert(val interface{}) {
-	ele := &BufEle{val : val}
-	if bp.head == nil {
-		// Inserting into empty list
-		bp.head = ele
-	} else {
-		bp.tail.next = ele
+// Maximum number of values, or 0 if unbounded
+func (q *Queue[T]) Cap() int {
+	return q.limit
+}
+
+// Append up to n oldest values to dst, leaving them in the queue
+func (q *Queue[T]) PeekN(dst []T, n int) []T {
+	if n > q.n { n = q.n }
+	for i := 0; i < n; i++ {
+		dst = append(dst, q.vals[(q.head + i) & (len(q.vals) - 1)])
+	}
+	return dst
+}
+
+// Remove up to n oldest values, appending them to dst
+func (q *Queue[T]) DrainN(dst []T, n int) []T {
+	if n > q.n { n = q.n }
+	for i := 0; i < n; i++ {
+		dst = append(dst, q.Remove())
 	}
-	bp.tail = ele
+	return dst
 }
 
-func (bp *Buf) Front() interface{} {
-	if bp.head == nil { return nil }
-	return bp.head.val
+// Remove every value for which drop returns true, keeping the rest
+// in order.  Returns number removed
+func (q *Queue[T]) RemoveIf(drop func(T) bool) int {
+	var zero T
+	mask := len(q.vals) - 1
+	kept := 0
+	for i := 0; i < q.n; i++ {
+		v := q.vals[(q.head + i) & mask]
+		if !drop(v) {
+			q.vals[(q.head + kept) & mask] = v
+			kept++
+		}
+	}
+	for i := kept; i < q.n; i++ {
+		q.vals[(q.head + i) & mask] = zero
+	}
+	removed := q.n - kept
+	q.n = kept
+	return removed
 }
 
-func (bp *Buf) Remove() interface{} {
-	e := bp.head
-	if e == nil { return nil }
-	bp.head = e.next
-	// List becoming empty 
-	if e == bp.tail { bp.tail = nil }
-	return e.val
+// Iterate over values from oldest to newest.  Queue must not be
+// modified during iteration
+func (q *Queue[T]) All() iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for i := 0; i < q.n; i++ {
+			if !yield(q.vals[(q.head + i) & (len(q.vals) - 1)]) {
+				return
+			}
+		}
+	}
 }
 
-func (bp *Buf) Empty() bool {
-	return bp.head == nil
+// Remove all values
+func (q *Queue[T]) Flush() {
+	clear(q.vals)
+	q.head = 0
+	q.n = 0
 }
 
-func (bp *Buf) Flush() {
-	bp.head = nil
-	bp.tail = nil
-}
\ No newline at end of file
+// Double storage, moving values to the front
+func (q *Queue[T]) grow() {
+	size := 2 * len(q.vals)
+	if size == 0 { size = 4 }
+	nvals := make([]T, size)
+	for i := 0; i < q.n; i++ {
+		nvals[i] = q.vals[(q.head + i) & (len(q.vals) - 1)]
+	}
+	q.vals = nvals
+	q.head = 0
+}
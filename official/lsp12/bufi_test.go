@@ -0,0 +1,209 @@
+package lsp12
+
+import (
+	"math/rand"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// Queue with storage of 4, holding 3, 4, 5, 6 from slot 2 onwards, so
+// that its values wrap round end of storage
+func wrappedQueue(limit int) *Queue[int] {
+	q := NewQueue[int](limit)
+	for v := 1; v <= 4; v++ {
+		q.Insert(v)
+	}
+	q.Remove()
+	q.Remove()
+	q.Insert(5)
+	q.Insert(6)
+	return q
+}
+
+// Values from oldest to newest
+func contents(q *Queue[int]) []int {
+	vals := []int{}
+	for v := range q.All() {
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+// Check that length is right and that storage outside queue holds no
+// stale values.  Tests only insert nonzero values
+func checkQueue(t *testing.T, name string, q *Queue[int], want []int) {
+	t.Helper()
+	if got := contents(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: holds %v, want %v", name, got, want)
+	}
+	if q.Len() != len(want) || q.Empty() != (len(want) == 0) {
+		t.Errorf("%s: Len %v, Empty %v with %v values", name, q.Len(), q.Empty(), len(want))
+	}
+	if len(q.vals) & (len(q.vals) - 1) != 0 {
+		t.Errorf("%s: storage of %v", name, len(q.vals))
+	}
+	for i := q.n; i < len(q.vals); i++ {
+		if v := q.vals[(q.head + i) & (len(q.vals) - 1)]; v != 0 {
+			t.Errorf("%s: stale %v left in storage", name, v)
+		}
+	}
+}
+
+func TestQueueOps(t *testing.T) {
+	isEven := func(v int) bool { return v % 2 == 0 }
+	tests := []struct {
+		name string
+		q *Queue[int]
+		op func(q *Queue[int]) []int // Returns what operation returned
+		want []int // Values returned
+		left []int // Values left in queue
+		size int // Storage afterwards
+	}{
+		{"insert into empty", NewQueue[int](0),
+			func(q *Queue[int]) []int { return []int{b2i(q.Insert(1))} },
+			[]int{1}, []int{1}, 4},
+		{"insert grows wrapped", wrappedQueue(0),
+			func(q *Queue[int]) []int { return []int{b2i(q.Insert(7))} },
+			[]int{1}, []int{3, 4, 5, 6, 7}, 8},
+		{"insert into full", wrappedQueue(4),
+			func(q *Queue[int]) []int { return []int{b2i(q.Insert(7))} },
+			[]int{0}, []int{3, 4, 5, 6}, 4},
+		{"remove across end", wrappedQueue(0),
+			func(q *Queue[int]) []int { return []int{q.Remove(), q.Remove(), q.Remove()} },
+			[]int{3, 4, 5}, []int{6}, 4},
+		{"remove from empty", NewQueue[int](0),
+			func(q *Queue[int]) []int { return []int{q.Remove(), q.Front()} },
+			[]int{0, 0}, []int{}, 0},
+		{"front", wrappedQueue(0),
+			func(q *Queue[int]) []int { return []int{q.Front()} },
+			[]int{3}, []int{3, 4, 5, 6}, 4},
+		{"peek across end", wrappedQueue(0),
+			func(q *Queue[int]) []int { return q.PeekN([]int{9}, 3) },
+			[]int{9, 3, 4, 5}, []int{3, 4, 5, 6}, 4},
+		{"peek more than held", wrappedQueue(0),
+			func(q *Queue[int]) []int { return q.PeekN(nil, 10) },
+			[]int{3, 4, 5, 6}, []int{3, 4, 5, 6}, 4},
+		{"drain across end", wrappedQueue(0),
+			func(q *Queue[int]) []int { return q.DrainN([]int{9}, 3) },
+			[]int{9, 3, 4, 5}, []int{6}, 4},
+		{"drain more than held", wrappedQueue(0),
+			func(q *Queue[int]) []int { return q.DrainN(nil, 10) },
+			[]int{3, 4, 5, 6}, []int{}, 4},
+		{"remove some across end", wrappedQueue(0),
+			func(q *Queue[int]) []int { return []int{q.RemoveIf(isEven)} },
+			[]int{2}, []int{3, 5}, 4},
+		{"remove none", wrappedQueue(0),
+			func(q *Queue[int]) []int { return []int{q.RemoveIf(func(int) bool { return false })} },
+			[]int{0}, []int{3, 4, 5, 6}, 4},
+		{"remove all", wrappedQueue(0),
+			func(q *Queue[int]) []int { return []int{q.RemoveIf(func(int) bool { return true })} },
+			[]int{4}, []int{}, 4},
+		{"remove then insert", wrappedQueue(4),
+			func(q *Queue[int]) []int {
+				q.RemoveIf(isEven)
+				return []int{b2i(q.Insert(7)), b2i(q.Insert(8)), b2i(q.Insert(9))}
+			},
+			[]int{1, 1, 0}, []int{3, 5, 7, 8}, 4},
+		{"stop iterating", wrappedQueue(0),
+			func(q *Queue[int]) []int {
+				var vals []int
+				for v := range q.All() {
+					vals = append(vals, v)
+					if len(vals) == 2 {
+						break
+					}
+				}
+				return vals
+			},
+			[]int{3, 4}, []int{3, 4, 5, 6}, 4},
+		{"flush", wrappedQueue(0),
+			func(q *Queue[int]) []int { q.Flush(); return nil },
+			nil, []int{}, 4},
+		{"flush then insert", wrappedQueue(4),
+			func(q *Queue[int]) []int {
+				q.Flush()
+				return []int{b2i(q.Insert(7))}
+			},
+			[]int{1}, []int{7}, 4},
+	}
+	for _, tc := range tests {
+		got := tc.op(tc.q)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: returned %v, want %v", tc.name, got, tc.want)
+		}
+		if len(tc.q.vals) != tc.size {
+			t.Errorf("%s: storage of %v, want %v", tc.name, len(tc.q.vals), tc.size)
+		}
+		checkQueue(t, tc.name, tc.q, tc.left)
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Random operations match those on a plain slice, as queue grows many
+// times with values wrapping round
+func TestQueueModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, limit := range []int{0, 5, 100} {
+		q := NewQueue[int](limit)
+		var model []int
+		next := 1
+		for step := 0; step < 5000; step++ {
+			switch op := rng.Intn(10); {
+			case op < 5:
+				ok := q.Insert(next)
+				if wantOk := limit == 0 || len(model) < limit; ok != wantOk {
+					t.Fatalf("limit %v, step %v: Insert returned %v", limit, step, ok)
+				}
+				if ok {
+					model = append(model, next)
+				}
+				next++
+			case op < 7:
+				var want int
+				if len(model) > 0 {
+					want, model = model[0], model[1:]
+				}
+				if v := q.Remove(); v != want {
+					t.Fatalf("limit %v, step %v: Remove returned %v, want %v", limit, step, v, want)
+				}
+			case op < 8:
+				n := min(rng.Intn(4), len(model))
+				got := q.DrainN(nil, n)
+				if !slices.Equal(got, model[:n]) {
+					t.Fatalf("limit %v, step %v: DrainN returned %v", limit, step, got)
+				}
+				model = model[n:]
+			case op < 9:
+				mod := rng.Intn(5) + 2
+				drop := func(v int) bool { return v % mod == 0 }
+				var kept []int
+				for _, v := range model {
+					if !drop(v) {
+						kept = append(kept, v)
+					}
+				}
+				if n := q.RemoveIf(drop); n != len(model) - len(kept) {
+					t.Fatalf("limit %v, step %v: RemoveIf returned %v", limit, step, n)
+				}
+				model = kept
+			default:
+				n := rng.Intn(4)
+				got := q.PeekN(nil, n)
+				if !slices.Equal(got, model[:min(n, len(model))]) {
+					t.Fatalf("limit %v, step %v: PeekN returned %v", limit, step, got)
+				}
+			}
+			checkQueue(t, "model", q, append([]int{}, model...))
+			if t.Failed() {
+				t.Fatalf("limit %v, step %v", limit, step)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Version & capability negotiation.  Client offers the versions and
+// features it supports in the payload of its connection request.
+// Server picks what both support and returns the result in the payload
+// of its acknowledgement, or refuses with the reason in the payload of
+// an invalid message.  Peers from before negotiation send no payload,
+// and are taken to speak version 1 with basic features
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+const (
+	ProtocolVersion = 2 // Highest version spoken by this implementation
+	legacyVersion = 1 // Version spoken by peers that don't negotiate
+)
+
+// Encodings
+const (
+	EncodingJSON = "json"
+)
+
+// What peers that don't negotiate support
+func legacyCapabilities() Capabilities {
+	return Capabilities{
+		Version: legacyVersion,
+		Encodings: []string{EncodingJSON},
+		Window: 1,
+		MaxPayload: MaxPayloadSize,
+	}
+}
+
+// What we support, as limited by params
+func localCapabilities(params *LspParams) Capabilities {
+	maxPayload := MaxPayloadSize
+	if params.MaxPayload > 0 {
+		maxPayload = min(params.MaxPayload, MaxPayloadSize)
+	}
+	return Capabilities{
+		Version: ProtocolVersion,
+		MinVersion: max(params.MinVersion, legacyVersion),
+		Encodings: []string{EncodingJSON},
+		Compression: knownCodecs(params.Compression),
+		Coalesce: true,
+		PathProbe: true,
+		FEC: true,
+		Window: 1,
+		MaxPayload: maxPayload,
+		EpochMilliseconds: params.EpochMilliseconds,
+		EpochLimit: params.EpochLimit,
+	}
+}
+
+// Connection request carrying offer
+func genOfferMessage(offer Capabilities) *LspMessage {
+	m := GenConnectMessage()
+	m.Payload, _ = json.Marshal(offer)
+	return m
+}
+
+// Offer carried by connection request
+func parseOffer(payload []byte) (Capabilities, error) {
+	if len(payload) == 0 {
+		return legacyCapabilities(), nil
+	}
+	var offer Capabilities
+	err := json.Unmarshal(payload, &offer)
+	return offer, err
+}
+
+// Settle on what both sides support.  Returns reason for refusal
+// if there is nothing in common
+func negotiate(offer, local Capabilities) (Capabilities, string) {
+	var agreed Capabilities
+	offer.MinVersion = max(offer.MinVersion, legacyVersion)
+	agreed.Version = min(offer.Version, local.Version)
+	if agreed.Version < max(offer.MinVersion, local.MinVersion) {
+		return agreed, fmt.Sprintf("No common protocol version.  Client offers %v-%v, server %v-%v",
+			offer.MinVersion, offer.Version, local.MinVersion, local.Version)
+	}
+	var ok bool
+	if agreed.Encodings, ok = pickCommon(offer.Encodings, local.Encodings); !ok {
+		return agreed, fmt.Sprintf("No common encoding in %v", offer.Encodings)
+	}
+	// Optional features.  Fine to go without
+	agreed.Compression, _ = pickCommon(offer.Compression, local.Compression)
+	agreed.Encryption, _ = pickCommon(offer.Encryption, local.Encryption)
+	agreed.Coalesce = offer.Coalesce && local.Coalesce
+	agreed.PathProbe = offer.PathProbe && local.PathProbe
+	agreed.FEC = offer.FEC && local.FEC
+	agreed.Window = minLimit(offer.Window, local.Window)
+	agreed.MaxPayload = minLimit(offer.MaxPayload, local.MaxPayload)
+	if agreed.Compression != nil {
+		// Leave room in packet for prefix
+		agreed.MaxPayload = min(agreed.MaxPayload, MaxPayloadSize - 1)
+	}
+	return agreed, ""
+}
+
+// First of offered that is also supported, as single-entry list
+func pickCommon(offered, supported []string) ([]string, bool) {
+	for _, s := range offered {
+		if slices.Contains(supported, s) {
+			return []string{s}, true
+		}
+	}
+	return nil, false
+}
+
+// Smaller of two limits, where 0 means no limit
+func minLimit(a, b int) int {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+// Fit client's proposed timing to server policy.  Epoch length is a
+// whole number of shard ticks, since those drive server's timers
+func clampTiming(offer Capabilities, params *LspParams) (ms, limit int) {
+	tick := tickMilliseconds(params)
+	ms = params.EpochMilliseconds
+	if offer.EpochMilliseconds > 0 &&
+		(params.MinEpochMilliseconds > 0 || params.MaxEpochMilliseconds > 0) {
+		ms = max(offer.EpochMilliseconds, params.MinEpochMilliseconds)
+		if params.MaxEpochMilliseconds > 0 {
+			ms = min(ms, params.MaxEpochMilliseconds)
+		}
+		ms = max((ms + tick/2) / tick, 1) * tick
+	}
+	limit = params.EpochLimit
+	if offer.EpochLimit > 0 && (params.MinEpochLimit > 0 || params.MaxEpochLimit > 0) {
+		limit = max(offer.EpochLimit, params.MinEpochLimit)
+		if params.MaxEpochLimit > 0 {
+			limit = min(limit, params.MaxEpochLimit)
+		}
+	}
+	return ms, limit
+}
+
+// Check what server agreed to, from payload of its acknowledgement
+func acceptAgreed(payload []byte, local Capabilities) (Capabilities, error) {
+	var agreed Capabilities
+	if len(payload) == 0 {
+		agreed = legacyCapabilities()
+		if agreed.Version < local.MinVersion {
+			return agreed, lsplog.ConnectionRefused(
+				fmt.Sprintf("Server speaks version %v.  Need at least %v",
+					agreed.Version, local.MinVersion))
+		}
+	} else {
+		if err := json.Unmarshal(payload, &agreed); err != nil {
+			return agreed, lsplog.ConnectionRefused("Malformed acknowledgement: " + err.Error())
+		}
+		if agreed.Version < local.MinVersion || agreed.Version > local.Version {
+			return agreed, lsplog.ConnectionRefused(
+				fmt.Sprintf("Server chose unsupported version %v", agreed.Version))
+		}
+		if len(agreed.Compression) > 0 && !slices.Contains(local.Compression, agreed.Compression[0]) {
+			return agreed, lsplog.ConnectionRefused(
+				fmt.Sprintf("Server chose unsupported compression %v", agreed.Compression[0]))
+		}
+	}
+	// Server that doesn't set timing leaves us with our own
+	if agreed.EpochMilliseconds <= 0 {
+		agreed.EpochMilliseconds = local.EpochMilliseconds
+	}
+	if agreed.EpochLimit <= 0 {
+		agreed.EpochLimit = local.EpochLimit
+	}
+	return agreed, nil
+}
+
+// Agreed capabilities as sent in acknowledgement.  Legacy clients
+// get an empty acknowledgement, as they expect
+func agreedPayload(agreed Capabilities) []byte {
+	if agreed.Version == legacyVersion {
+		return nil
+	}
+	b, _ := json.Marshal(agreed)
+	return b
+}
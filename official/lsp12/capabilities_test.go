@@ -0,0 +1,49 @@
+package lsp12
+
+import "testing"
+
+func TestClampTiming(t *testing.T) {
+	server := LspParams{EpochMilliseconds: 2000, EpochLimit: 5}
+	ranged := server
+	ranged.MinEpochMilliseconds, ranged.MaxEpochMilliseconds = 500, 10000
+	ranged.MinEpochLimit, ranged.MaxEpochLimit = 3, 20
+	tests := []struct {
+		name string
+		params LspParams
+		ms, limit int // Proposed
+		wantMs, wantLimit int
+	}{
+		{"no range", server, 500, 10, 2000, 5},
+		{"LAN", ranged, 500, 10, 500, 10},
+		{"satellite", ranged, 8000, 30, 8000, 20},
+		{"too short", ranged, 100, 1, 500, 3},
+		{"too long", ranged, 60000, 5, 10000, 5},
+		{"rounded to tick", ranged, 733, 5, 750, 5},
+		{"none proposed", ranged, 0, 0, 2000, 5},
+	}
+	for _, tc := range tests {
+		offer := Capabilities{EpochMilliseconds: tc.ms, EpochLimit: tc.limit}
+		ms, limit := clampTiming(offer, &tc.params)
+		if ms != tc.wantMs || limit != tc.wantLimit {
+			t.Errorf("%s: got %vms, limit %v.  Want %vms, limit %v",
+				tc.name, ms, limit, tc.wantMs, tc.wantLimit)
+		}
+	}
+}
+
+// Shard ticks time agreed epochs exactly, unless they had to be rounded
+func TestEpochTicks(t *testing.T) {
+	sh := &serverShard{params: &LspParams{EpochMilliseconds: 2000, MinEpochMilliseconds: 500}}
+	if tick := tickMilliseconds(sh.params); tick != 50 {
+		t.Fatalf("tick of %vms, want 50ms", tick)
+	}
+	for _, ms := range []int{500, 750, 2000, 8000} {
+		if n := sh.ticksFor(ms); n * 50 != int64(ms) {
+			t.Errorf("%vms timed as %v ticks", ms, n)
+		}
+	}
+	sh.params = &LspParams{EpochMilliseconds: 2000}
+	if n := sh.ticksFor(2000); n != 1 {
+		t.Errorf("server's own epoch is %v ticks without range, want 1", n)
+	}
+}
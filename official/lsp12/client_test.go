@@ -0,0 +1,285 @@
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Transport that stops sending after its first few packets
+type muteTransport struct {
+	PacketTransport
+	left atomic.Int32
+}
+
+func (t *muteTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	if t.left.Add(-1) < 0 {
+		return len(b), nil
+	}
+	return t.PacketTransport.WriteTo(b, addr)
+}
+
+// Transport that keeps a copy of every datagram it sends.  Its wrap
+// method serves as a rig wrapper
+type recordTransport struct {
+	PacketTransport
+	lock sync.Mutex
+	sent [][]byte
+}
+
+func (t *recordTransport) wrap(pt PacketTransport) PacketTransport {
+	t.PacketTransport = pt
+	return t
+}
+
+func (t *recordTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	t.lock.Lock()
+	t.sent = append(t.sent, slices.Clone(b))
+	t.lock.Unlock()
+	return t.PacketTransport.WriteTo(b, addr)
+}
+
+// Messages sent so far of type t, with those sharing a datagram split
+func (t *recordTransport) messages(typ byte) []*LspMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var msgs []*LspMessage
+	for _, d := range t.sent {
+		for len(d) > 0 {
+			m, rest, err := extractMessage(d)
+			if err != nil {
+				break
+			}
+			if m.Type == typ {
+				msgs = append(msgs, m)
+			}
+			d = rest
+		}
+	}
+	return msgs
+}
+
+// Server and its clients, stepped through epochs by a manual clock
+type testRig struct {
+	t *testing.T
+	clock *ManualClock
+	st PacketTransport // Server's transport
+	dialer func() (PacketTransport, error)
+	srv *LspServer
+	clis []*LspClient // Still to be closed
+}
+
+// Transport wrapper, for tests that interfere with packets
+type wrapper func(PacketTransport) PacketTransport
+
+// Server on fresh pipe network, with transport wrapped by wrap if given.
+// params gets the rig's clock.  Everything is closed when test ends
+func newRig(t *testing.T, params *LspParams, wrap wrapper) *testRig {
+	pn := NewPipeNetwork()
+	var st PacketTransport = pn.Listen()
+	if wrap != nil {
+		st = wrap(st)
+	}
+	return newRigOver(t, params, st, func() (PacketTransport, error) {
+		return pn.Dial(st.LocalAddr())
+	})
+}
+
+// Server over st, with clients using transports from dialer
+func newRigOver(t *testing.T, params *LspParams, st PacketTransport,
+	dialer func() (PacketTransport, error)) *testRig {
+	r := &testRig{t: t, clock: NewManualClock(time.Unix(0, 0)), st: st, dialer: dialer}
+	params.Clock = r.clock
+	r.srv = NewLspServerTransport(st, params)
+	t.Cleanup(r.close)
+	return r
+}
+
+// Connect client, with transport wrapped by wrap if given
+func (r *testRig) dial(params *LspParams, wrap wrapper) (*LspClient, error) {
+	ct, err := r.dialer()
+	if err != nil {
+		return nil, err
+	}
+	if wrap != nil {
+		ct = wrap(ct)
+	}
+	cli, err := NewLspClientTransport(ct, params)
+	if err == nil {
+		r.clis = append(r.clis, cli)
+	}
+	return cli, err
+}
+
+// As dial, failing test if client can't connect
+func (r *testRig) connect(params *LspParams, wrap wrapper) *LspClient {
+	r.t.Helper()
+	cli, err := r.dial(params, wrap)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return cli
+}
+
+// Run f, stepping clock an epoch at a time until it returns
+func (r *testRig) step(f func()) {
+	done := make(chan bool)
+	go func() {
+		f()
+		close(done)
+	}()
+	ms := r.srv.params.Load().EpochMilliseconds
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			r.clock.Advance(time.Duration(ms) * time.Millisecond)
+		}
+	}
+}
+
+// Step through n epochs
+func (r *testRig) epochs(n int) {
+	ms := r.srv.params.Load().EpochMilliseconds
+	for i := 0; i < n; i++ {
+		r.clock.Advance(time.Duration(ms) * time.Millisecond)
+	}
+}
+
+// Close client, stepping clock until it has
+func (r *testRig) closeClient(cli *LspClient) {
+	r.clis = slices.DeleteFunc(r.clis, func(c *LspClient) bool { return c == cli })
+	r.step(cli.Close)
+}
+
+// Close remaining clients, then server
+func (r *testRig) close() {
+	r.step(func() {
+		for _, cli := range r.clis {
+			cli.Close()
+		}
+		r.clis = nil
+		r.srv.CloseAll()
+	})
+}
+
+// Wrapper letting only the first n packets through
+func mute(n int32) wrapper {
+	return func(t PacketTransport) PacketTransport {
+		mt := &muteTransport{PacketTransport: t}
+		mt.left.Store(n)
+		return mt
+	}
+}
+
+// Client gives up on silent server at the epoch limit, and has done so
+// by the time Advance returns
+func TestManualClockEpochLimit(t *testing.T) {
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	// Server acknowledges connection request, then goes silent
+	r := newRig(t, params, mute(1))
+	cli := r.connect(params, nil)
+	for i := 1; i <= params.EpochLimit + 1; i++ {
+		r.epochs(1)
+		lost := cli.State() == ClientLost
+		if lost != (i > params.EpochLimit) {
+			t.Fatalf("after %v silent epochs, lost is %v", i, lost)
+		}
+	}
+	if _, err := cli.Read(); !errors.Is(err, lsplog.ErrConnectionLost) {
+		t.Errorf("Read returned %v", err)
+	}
+}
+
+// Read during Close, with a write still unacknowledged, reports that
+// application closed connection, not that contact was lost
+func TestReadDuringClose(t *testing.T) {
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	r := newRig(t, params, nil)
+	cli := r.connect(params, nil)
+	// Server goes quiet, so write stays unacknowledged
+	r.st.Close()
+	if err := cli.Write([]byte("unacked")); err != nil {
+		t.Fatal(err)
+	}
+	// Close gives up on write once epoch limit is reached, as server
+	// does on client
+	closed := make(chan bool)
+	go func() {
+		r.closeClient(cli)
+		close(closed)
+	}()
+	_, err := cli.Read()
+	if !errors.Is(err, lsplog.ErrConnectionClosed) || errors.Is(err, lsplog.ErrTimeout) {
+		t.Errorf("Read during Close returned %v", err)
+	}
+	<-closed
+}
+
+// Write refuses Done channel without room for its outcome, and every
+// outcome it accepts is delivered
+func TestWriteNotifyRoom(t *testing.T) {
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	// Server acknowledges connection request, then nothing else
+	r := newRig(t, params, mute(1))
+	cli := r.connect(params, nil)
+	if err := cli.WriteNotify([]byte("x"), make(chan error)); !errors.Is(err, lsplog.ErrNoRoom) {
+		t.Errorf("write with unbuffered channel returned %v", err)
+	}
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		if err := cli.WriteNotify([]byte("x"), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cli.WriteNotify([]byte("x"), done); !errors.Is(err, lsplog.ErrNoRoom) {
+		t.Errorf("write with channel already spoken for returned %v", err)
+	}
+	r.closeClient(cli)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("unacknowledged write reported success")
+			}
+		default:
+			t.Fatalf("only %v outcomes reported", i)
+		}
+	}
+	if n := heldRoom(done); n != 0 {
+		t.Errorf("room for %v outcomes still held", n)
+	}
+}
+
+// Room held on done
+func heldRoom(done chan error) int {
+	doneRoom.Lock()
+	defer doneRoom.Unlock()
+	return doneRoom.held[done]
+}
+
+// Writes after Close fail without holding room on Done channel
+func TestWriteNotifyAfterClose(t *testing.T) {
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	r := newRig(t, params, nil)
+	cli := r.connect(params, nil)
+	r.closeClient(cli)
+	done := make(chan error, 1)
+	for i := 0; i < 200; i++ {
+		if err := cli.WriteNotify([]byte("x"), done); !errors.Is(err, lsplog.ErrConnectionClosed) {
+			t.Fatalf("write after close returned %v", err)
+		}
+		if err := cli.Flush(); !errors.Is(err, lsplog.ErrConnectionClosed) {
+			t.Fatalf("flush after close returned %v", err)
+		}
+	}
+	if n := heldRoom(done); n != 0 {
+		t.Errorf("room for %v outcomes still held", n)
+	}
+}
@@ -0,0 +1,162 @@
+// Clocks.  Epochs normally follow real time.  ManualClock lets tests
+// drive them instead, so that timeouts, resends & connection loss can be
+// exercised without waiting
+package lsp12
+
+import (
+	"sync"
+	"time"
+)
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// Clock whose ticks can wait for their receiver to finish with them
+type syncClock interface {
+	// As NewTicker, along with function to call once done with each tick
+	newSyncTicker(d time.Duration) (<-chan time.Time, func(), func())
+}
+
+// Ticker from clock, along with function to call once done with each
+// tick, which lets a syncClock know that the tick has been dealt with
+func newSyncTicker(clock Clock, d time.Duration) (<-chan time.Time, func(), func()) {
+	if sc, ok := clock.(syncClock); ok {
+		return sc.newSyncTicker(d)
+	}
+	tick, stop := clock.NewTicker(d)
+	return tick, stop, func() {}
+}
+
+// Clock set by params, or real time
+func paramsClock(params *LspParams) Clock {
+	if params.Clock == nil {
+		return realClock{}
+	}
+	return params.Clock
+}
+
+// Clock that only moves when told to
+type ManualClock struct {
+	lock sync.Mutex
+	now time.Time
+	tickers map[*manualTicker] bool
+}
+
+type manualTicker struct {
+	c chan time.Time
+	period time.Duration
+	next time.Time
+	ack chan bool // Receiver done with tick.  nil if it doesn't say
+	stop func()
+	stopped chan bool // Closed when ticker stopped
+	stopOnce sync.Once
+}
+
+// Clock starting at time start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start, tickers: make(map[*manualTicker] bool)}
+}
+
+func (mc *ManualClock) Now() time.Time {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.now
+}
+
+func (mc *ManualClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := mc.newTicker(d, false)
+	return t.c, t.stop
+}
+
+func (mc *ManualClock) newSyncTicker(d time.Duration) (<-chan time.Time, func(), func()) {
+	t := mc.newTicker(d, true)
+	done := func() {
+		select {
+		case t.ack <- true:
+		case <- t.stopped:
+		}
+	}
+	return t.c, t.stop, done
+}
+
+func (mc *ManualClock) newTicker(d time.Duration, acks bool) *manualTicker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	t := &manualTicker{
+		c: make(chan time.Time),
+		period: d,
+		next: mc.now.Add(d),
+		stopped: make(chan bool),
+	}
+	if acks {
+		t.ack = make(chan bool)
+	}
+	t.stop = func() {
+		t.stopOnce.Do(func() {
+			close(t.stopped)
+			mc.lock.Lock()
+			delete(mc.tickers, t)
+			mc.lock.Unlock()
+		})
+	}
+	mc.tickers[t] = true
+	return t
+}
+
+// Move clock forward by d, firing every tick that falls due, in order.
+// Returns once each tick has been taken by its receiver, or the ticker
+// stopped.  Client & server loops finish with each epoch before Advance
+// moves on, so all they do at an epoch, such as resending or declaring
+// a connection lost, is done by the time it returns.  Packets they send
+// reach the other end in the usual way, as they would in real time
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.lock.Lock()
+	target := mc.now.Add(d)
+	for {
+		var due *manualTicker
+		for t := range mc.tickers {
+			if !t.next.After(target) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			break
+		}
+		mc.now = due.next
+		due.next = due.next.Add(due.period)
+		now := mc.now
+		mc.lock.Unlock()
+		select {
+		case due.c <- now:
+			if due.ack != nil {
+				select {
+				case <- due.ack:
+				case <- due.stopped:
+				}
+			}
+		case <- due.stopped:
+		}
+		mc.lock.Lock()
+	}
+	mc.now = target
+	mc.lock.Unlock()
+}
+
+// Number of tickers running.  Client & server start their epoch
+// tickers before their constructors return
+func (mc *ManualClock) Tickers() int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return len(mc.tickers)
+}
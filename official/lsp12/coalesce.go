@@ -0,0 +1,169 @@
+// Coalescing.  With stop-and-wait, messages written while one awaits
+// acknowledgement pile up in the send queue.  When both ends support
+// it, they go as one bundle message under a single sequence number,
+// with each payload framed by its length as a uvarint, as many as fit
+// in a packet within the path MTU.  The receiver splits the bundle and
+// acknowledges it once.
+// Acknowledgements are held back until the end of the loop iteration,
+// or for the coalescing delay, so that they can share a datagram with
+// data going the same way.  Packets sharing a datagram are separated by
+// a newline, which our encoding never produces otherwise
+package lsp12
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Can message go in a bundle?  Nil payloads would arrive as empty ones
+func bundleable(m *LspMessage) bool {
+	return m.Type == MsgDATA && m.Payload != nil
+}
+
+// Room message takes in bundle
+func frameSize(m *LspMessage) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], uint64(len(m.Payload))) + len(m.Payload)
+}
+
+// Coalescing on this connection?
+func (con *lspConn) coalescing() bool {
+	return con.coalesce && !con.noDelay
+}
+
+// Largest bundle payload.  Whole bundle fits in one packet
+func (con *lspConn) maxBundle() int {
+	return payloadRoom(con.packetLimit())
+}
+
+// Take next message to send from queue.  When coalescing, data messages
+// queued behind it join it in a bundle, as many as fit in one packet.
+// Bundle expires once all its messages would have
+func (con *lspConn) nextToSend() *LspMessage {
+	sm := con.sendBuf.Remove()
+	if !con.coalescing() || !bundleable(sm) {
+		return sm
+	}
+	size := frameSize(sm)
+	count := 0
+	limit := con.maxBundle()
+	for m := range con.sendBuf.All() {
+		if !bundleable(m) || size + frameSize(m) > limit {
+			break
+		}
+		size += frameSize(m)
+		count++
+	}
+	if count == 0 {
+		return sm
+	}
+	bm := newMessage()
+	bm.Type = MsgBUNDLE
+	bm.Payload = getPayload(size)[:0]
+	bm.parts = make([]*LspMessage, 1, count + 1)
+	bm.parts[0] = sm
+	bm.parts = con.sendBuf.DrainN(bm.parts, count)
+	never := false
+	for _, m := range bm.parts {
+		bm.Payload = binary.AppendUvarint(bm.Payload, uint64(len(m.Payload)))
+		bm.Payload = append(bm.Payload, m.Payload...)
+		if m.expires == 0 {
+			never = true
+		}
+		bm.expires = max(bm.expires, m.expires)
+	}
+	if never {
+		bm.expires = 0
+	}
+	return bm
+}
+
+// Is there enough queued to fill a bundle, or something that can't
+// go in one?  Either way, no point waiting for more
+func (con *lspConn) bundleFull() bool {
+	size := 0
+	limit := con.maxBundle()
+	for m := range con.sendBuf.All() {
+		if !bundleable(m) {
+			return true
+		}
+		size += frameSize(m)
+		if size >= limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Split received bundle into data messages, and add them to q.  Adds
+// nothing and returns false if bundle is malformed, or a payload can't
+// be decoded
+func (con *lspConn) unbundle(bm *LspMessage, q *Queue[*LspMessage]) bool {
+	ok := len(bm.Payload) > 0
+	for p := bm.Payload; ok && len(p) > 0; {
+		n, k := binary.Uvarint(p)
+		if k <= 0 || n > uint64(len(p) - k) {
+			ok = false
+			break
+		}
+		m := newMessage()
+		m.Type = MsgDATA
+		m.ConnId = bm.ConnId
+		m.SeqNum = bm.SeqNum
+		m.Payload = copyPayload(p[k:k + int(n)])
+		con.unbundled = append(con.unbundled, m)
+		ok = con.decode(m)
+		p = p[k + int(n):]
+	}
+	for _, m := range con.unbundled {
+		if ok {
+			q.Insert(m)
+		} else {
+			ReleasePayload(m.Payload)
+			releaseMessage(m)
+		}
+	}
+	clear(con.unbundled)
+	con.unbundled = con.unbundled[:0]
+	return ok
+}
+
+// Pack acknowledgement and message into one datagram, appending to b.
+// If together they are larger than limit, returns where the second
+// starts, so that they can be sent separately.  Otherwise 0
+func appendCoalesced(b []byte, ack, msg *LspMessage, limit int) ([]byte, int) {
+	b = ack.appendPacket(b)
+	split := len(b) + 1
+	b = append(b, '\n')
+	b = msg.appendPacket(b)
+	if len(b) > limit {
+		return b, split
+	}
+	return b, 0
+}
+
+// Goroutine that fires once after each request on arm, which gives the
+// delay in milliseconds.  Stops once done is closed
+func coalesceTimer(clock Clock, arm chan int, fire chan int, done chan bool) {
+	for {
+		var ms int
+		select {
+		case ms = <- arm:
+		case <- done:
+			return
+		}
+		tick, stop := clock.NewTicker(time.Duration(ms) * time.Millisecond)
+		select {
+		case <- tick:
+			stop()
+		case <- done:
+			stop()
+			return
+		}
+		select {
+		case fire <- 1:
+		case <- done:
+			return
+		}
+	}
+}
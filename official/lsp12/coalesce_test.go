@@ -0,0 +1,146 @@
+package lsp12
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// Queued messages go out in bundles of as many as fit in a packet,
+// and come out of them as they went in.  Sizes are of payloads, with
+// -1 for nil
+func TestBundleSplit(t *testing.T) {
+	room := payloadRoom(maxPacketSize)
+	tests := []struct {
+		name string
+		sizes []int
+		noDelay bool
+		groups []int // Messages in each packet sent
+	}{
+		{"one", []int{10}, false, []int{1}},
+		{"all fit", []int{10, 20, 30, 40, 50}, false, []int{5}},
+		{"split", []int{300, 300, 300, 300, 300, 300, 300, 300}, false, []int{3, 3, 2}},
+		{"exactly full", []int{room / 2 - 2, room / 2 - 2, 1}, false, []int{2, 1}},
+		{"too large to share", []int{room - 10, 10, 10}, false, []int{1, 2}},
+		{"nil payload", []int{10, -1, 10, 10}, false, []int{1, 1, 2}},
+		{"empty payload", []int{10, 0, 10}, false, []int{3}},
+		{"no delay", []int{10, 20, 30}, true, []int{1, 1, 1}},
+	}
+	for _, tc := range tests {
+		con := newConn(netip.AddrPort{}, 1, 0)
+		con.coalesce = true
+		con.noDelay = tc.noDelay
+		var want [][]byte
+		for _, n := range tc.sizes {
+			m := newMessage()
+			m.Type = MsgDATA
+			m.ConnId = 1
+			if n >= 0 {
+				m.Payload = textPayload(n)
+			}
+			want = append(want, m.Payload)
+			con.queue(m, 0)
+		}
+		var groups []int
+		got := NewQueue[*LspMessage](0)
+		for !con.sendBuf.Empty() {
+			m := con.nextToSend()
+			switch m.Type {
+			case MsgBUNDLE:
+				if len(m.Payload) > room {
+					t.Errorf("%s: bundle of %v bytes", tc.name, len(m.Payload))
+				}
+				groups = append(groups, len(m.parts))
+				if !con.unbundle(m, got) {
+					t.Errorf("%s: bundle doesn't split", tc.name)
+				}
+			default:
+				groups = append(groups, 1)
+				got.Insert(m)
+			}
+		}
+		if !reflect.DeepEqual(groups, tc.groups) {
+			t.Errorf("%s: sent in groups of %v, want %v", tc.name, groups, tc.groups)
+		}
+		i := 0
+		for m := range got.All() {
+			if i >= len(want) || !bytes.Equal(m.Payload, want[i]) || (m.Payload == nil) != (want[i] == nil) {
+				t.Errorf("%s: message %v has %v bytes", tc.name, i, len(m.Payload))
+			}
+			i++
+		}
+		if i != len(want) {
+			t.Errorf("%s: %v messages out of %v", tc.name, i, len(want))
+		}
+	}
+}
+
+// Malformed bundle is refused whole
+func TestUnbundleMalformed(t *testing.T) {
+	con := newConn(netip.AddrPort{}, 1, 0)
+	for _, p := range [][]byte{{}, {2, 'a', 'b', 3, 'c'}, {0x80}} {
+		q := NewQueue[*LspMessage](0)
+		bm := &LspMessage{Type: MsgBUNDLE, ConnId: 1, Payload: p}
+		if con.unbundle(bm, q) || !q.Empty() {
+			t.Errorf("bundle %v split into %v messages", p, q.Len())
+		}
+	}
+}
+
+// Writes made while first awaits acknowledgement follow it in a single
+// bundle, unless client asks for no delay
+func TestCoalesceOnWire(t *testing.T) {
+	for _, noDelay := range []bool{false, true} {
+		params := &LspParams{EpochLimit: 5, EpochMilliseconds: 100}
+		// Server stays quiet while client writes
+		var gate *muteTransport
+		r := newRig(t, params, func(pt PacketTransport) PacketTransport {
+			gate = mute(1 << 30)(pt).(*muteTransport)
+			return gate
+		})
+		rec := &recordTransport{}
+		cparams := *params
+		cparams.NoDelay = noDelay
+		cli := r.connect(&cparams, rec.wrap)
+		gate.left.Store(0)
+		var want []string
+		for i := 0; i < 5; i++ {
+			want = append(want, fmt.Sprint("m", i))
+			if err := cli.Write([]byte(want[i])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		gate.left.Store(1 << 30)
+		var got []string
+		r.step(func() {
+			for range want {
+				_, b, err := r.srv.Read()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got = append(got, string(b))
+			}
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("noDelay %v: read %v", noDelay, got)
+		}
+		// Counting resent messages once
+		bundles := map[byte]bool{}
+		for _, m := range rec.messages(MsgBUNDLE) {
+			bundles[m.SeqNum] = true
+		}
+		sent := map[string]bool{}
+		for _, m := range rec.messages(MsgDATA) {
+			sent[string(m.Payload)] = true
+		}
+		if noDelay && (len(bundles) != 0 || len(sent) != 5) {
+			t.Errorf("noDelay: %v bundles, %v messages sent alone", len(bundles), len(sent))
+		}
+		if !noDelay && (len(bundles) != 1 || len(sent) != 1 || !sent["m0"]) {
+			t.Errorf("%v bundles, %v messages sent alone", len(bundles), len(sent))
+		}
+	}
+}
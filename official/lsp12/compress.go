@@ -0,0 +1,247 @@
+// Payload compression.  Client offers the codecs it supports in its
+// connection request, and server picks one.  Once a codec is agreed,
+// every data payload starts with a byte saying how the rest is encoded:
+// raw, or compressed with that codec.  Payloads shorter than the
+// sender's threshold, or that don't shrink, are sent raw
+package lsp12
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Codecs, as named in Capabilities.Compression
+const (
+	CompressionDeflate = "deflate"
+	CompressionLZW = "lzw" // Faster, but compresses less
+)
+
+// Payload prefixes
+const (
+	codecRaw = 0
+	codecDeflate = 1
+	codecLZW = 2
+)
+
+var codecByName = map [string] byte {
+	CompressionDeflate: codecDeflate,
+	CompressionLZW: codecLZW,
+}
+
+// Shortest payload worth compressing, unless LspParams says otherwise
+const defaultCompressMin = 128
+
+// Codecs from names that we support, in the same order
+func knownCodecs(names []string) []string {
+	var known []string
+	for _, name := range names {
+		if codecByName[name] != 0 {
+			known = append(known, name)
+		}
+	}
+	return known
+}
+
+// Codec agreed in caps, or 0 if payloads go without prefix
+func agreedCodec(caps Capabilities) byte {
+	if len(caps.Compression) == 0 {
+		return 0
+	}
+	return codecByName[caps.Compression[0]]
+}
+
+// Shortest payload to compress, from params
+func compressMin(params *LspParams) int {
+	if params.CompressMinSize > 0 {
+		return params.CompressMinSize
+	}
+	return defaultCompressMin
+}
+
+// Compressed output doesn't fit.  Payload goes raw instead
+var errNoGain = errors.New("compression doesn't shrink payload")
+
+// Collects compressor output, up to limit bytes
+type limitWriter struct {
+	b []byte
+	limit int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if len(w.b) + len(p) > w.limit {
+		return 0, errNoGain
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+// With WriteByte & Flush, LZW writes straight to us, without buffering
+func (w *limitWriter) WriteByte(c byte) error {
+	if len(w.b) >= w.limit {
+		return errNoGain
+	}
+	w.b = append(w.b, c)
+	return nil
+}
+
+func (w *limitWriter) Flush() error {
+	return nil
+}
+
+// Compressors are large, so they are pooled along with their output
+type deflater struct {
+	w *flate.Writer
+	out limitWriter
+}
+
+type lzwCompressor struct {
+	w *lzw.Writer
+	out limitWriter
+}
+
+var deflaterPool = sync.Pool{New: func() interface{} {
+	d := new(deflater)
+	d.w, _ = flate.NewWriter(&d.out, flate.DefaultCompression)
+	return d
+}}
+
+var lzwCompressorPool = sync.Pool{New: func() interface{} {
+	c := new(lzwCompressor)
+	c.w = lzw.NewWriter(&c.out, lzw.LSB, 8).(*lzw.Writer)
+	return c
+}}
+
+// Compress src into dst, which it must end up shorter than
+func compressInto(codec byte, dst, src []byte) ([]byte, error) {
+	var w io.WriteCloser
+	var out *limitWriter
+	switch codec {
+	case codecDeflate:
+		d := deflaterPool.Get().(*deflater)
+		defer deflaterPool.Put(d)
+		d.w.Reset(&d.out)
+		w, out = d.w, &d.out
+	case codecLZW:
+		c := lzwCompressorPool.Get().(*lzwCompressor)
+		defer lzwCompressorPool.Put(c)
+		c.w.Reset(&c.out, lzw.LSB, 8)
+		w, out = c.w, &c.out
+	}
+	out.b, out.limit = dst, len(src) - 1
+	_, err := w.Write(src)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	dst = out.b
+	out.b = nil
+	return dst, err
+}
+
+// Payload as sent on connection, with prefix.  Takes over payload,
+// which goes back to pool once replaced
+func (con *lspConn) encode(payload []byte) []byte {
+	if con.codec == 0 || payload == nil {
+		return payload
+	}
+	b := getPayload(len(payload) + 1)
+	if len(payload) >= con.compressMin {
+		b[0] = con.codec
+		if c, err := compressInto(con.codec, b[1:1], payload); err == nil {
+			ReleasePayload(payload)
+			return b[:1 + len(c)]
+		}
+	}
+	b[0] = codecRaw
+	copy(b[1:], payload)
+	ReleasePayload(payload)
+	return b
+}
+
+// Decompressors, pooled along with their input
+type inflater struct {
+	r io.ReadCloser
+	in bytes.Reader
+}
+
+type lzwDecompressor struct {
+	r *lzw.Reader
+	in bytes.Reader
+}
+
+var inflaterPool = sync.Pool{New: func() interface{} {
+	d := new(inflater)
+	d.r = flate.NewReader(&d.in)
+	return d
+}}
+
+var lzwDecompressorPool = sync.Pool{New: func() interface{} {
+	d := new(lzwDecompressor)
+	d.r = lzw.NewReader(&d.in, lzw.LSB, 8).(*lzw.Reader)
+	return d
+}}
+
+// Decompress src into dst, failing if it comes to more than max bytes
+func decompressInto(codec byte, dst, src []byte, max int) ([]byte, bool) {
+	var r io.Reader
+	switch codec {
+	case codecDeflate:
+		d := inflaterPool.Get().(*inflater)
+		defer inflaterPool.Put(d)
+		d.in.Reset(src)
+		d.r.(flate.Resetter).Reset(&d.in, nil)
+		r = d.r
+	case codecLZW:
+		d := lzwDecompressorPool.Get().(*lzwDecompressor)
+		defer lzwDecompressorPool.Put(d)
+		d.in.Reset(src)
+		d.r.Reset(&d.in, lzw.LSB, 8)
+		r = d.r
+	default:
+		return dst, false
+	}
+	// Room for one byte beyond, to tell full from too large
+	dst = dst[:max + 1]
+	n := 0
+	for {
+		k, err := r.Read(dst[n:])
+		n += k
+		if err == io.EOF {
+			return dst[:n], n <= max
+		}
+		if err != nil || n == len(dst) {
+			return dst, false
+		}
+	}
+}
+
+// Strip prefix from payload of received message, decompressing if
+// needed.  Returns false if it can't be decoded, or decodes to more
+// than the agreed payload limit
+func (con *lspConn) decode(m *LspMessage) bool {
+	p := m.Payload
+	if con.codec == 0 || p == nil {
+		return true
+	}
+	if len(p) == 0 {
+		return false
+	}
+	if p[0] == codecRaw {
+		// Shift in place, so buffer stays in its pool size class
+		n := copy(p, p[1:])
+		m.Payload = p[:n]
+		return true
+	}
+	b := getPayload(con.caps.MaxPayload + 1)
+	d, ok := decompressInto(p[0], b, p[1:], con.caps.MaxPayload)
+	if !ok {
+		ReleasePayload(b)
+		return false
+	}
+	ReleasePayload(p)
+	m.Payload = d
+	return true
+}
@@ -0,0 +1,111 @@
+package lsp12
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Payload of n bytes that compresses well
+func textPayload(n int) []byte {
+	return bytes.Repeat([]byte("abcdefgh"), n / 8 + 1)[:n]
+}
+
+// Payload of n bytes that doesn't compress
+func noisePayload(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// Payloads survive encoding & decoding with either codec.  Those shorter
+// than the threshold, or that don't shrink, go raw.  Default threshold
+// is where deflate stops storing its input as is
+func TestCompressRoundTrip(t *testing.T) {
+	threshold := compressMin(&LspParams{})
+	tests := []struct {
+		name string
+		payload []byte
+		compressed bool
+	}{
+		{"empty", []byte{}, false},
+		{"below threshold", textPayload(threshold - 1), false},
+		{"at threshold", textPayload(threshold), true},
+		{"large", textPayload(1000), true},
+		{"no gain", noisePayload(1000), false},
+	}
+	for _, codec := range []string{CompressionDeflate, CompressionLZW} {
+		caps := Capabilities{Compression: []string{codec}, MaxPayload: MaxPayloadSize}
+		con := &lspConn{caps: caps, codec: agreedCodec(caps), compressMin: threshold}
+		for _, tc := range tests {
+			sent := con.encode(bytes.Clone(tc.payload))
+			if compressed := sent[0] != codecRaw; compressed != tc.compressed {
+				t.Errorf("%s, %s: prefix %v", codec, tc.name, sent[0])
+			}
+			if tc.compressed && len(sent) >= len(tc.payload) {
+				t.Errorf("%s, %s: %v bytes encoded as %v", codec, tc.name, len(tc.payload), len(sent))
+			}
+			m := &LspMessage{Type: MsgDATA, Payload: sent}
+			if !con.decode(m) || !bytes.Equal(m.Payload, tc.payload) {
+				t.Errorf("%s, %s: decoded to %v bytes", codec, tc.name, len(m.Payload))
+			}
+		}
+	}
+}
+
+// Connection without a codec leaves payloads alone, and nil stays nil
+func TestCompressNone(t *testing.T) {
+	con := &lspConn{compressMin: defaultCompressMin}
+	p := textPayload(1000)
+	if b := con.encode(p); !bytes.Equal(b, textPayload(1000)) {
+		t.Errorf("payload changed without codec")
+	}
+	con.codec = codecDeflate
+	if b := con.encode(nil); b != nil {
+		t.Errorf("nil payload encoded as %v", b)
+	}
+}
+
+// Payload that inflates to more than the agreed limit is refused
+func TestDecompressTooLarge(t *testing.T) {
+	caps := Capabilities{Compression: []string{CompressionDeflate}, MaxPayload: 1000}
+	con := &lspConn{caps: caps, codec: agreedCodec(caps), compressMin: 1}
+	for _, n := range []int{1000, 1001} {
+		m := &LspMessage{Type: MsgDATA, Payload: con.encode(textPayload(n))}
+		if ok := con.decode(m); ok != (n <= 1000) {
+			t.Errorf("%v bytes decoded: %v", n, ok)
+		}
+	}
+}
+
+// Client & server agree on codec, and only payloads at the threshold or
+// above go compressed on the wire
+func TestCompressOnWire(t *testing.T) {
+	params := &LspParams{EpochLimit: 5, EpochMilliseconds: 100, NoDelay: true,
+		Compression: []string{CompressionLZW, CompressionDeflate}, CompressMinSize: 64}
+	r := newRig(t, params, nil)
+	rec := &recordTransport{}
+	cli := r.connect(params, rec.wrap)
+	if c := cli.Capabilities().Compression; len(c) != 1 || c[0] != CompressionLZW {
+		t.Fatalf("agreed compression %v", c)
+	}
+	payloads := [][]byte{textPayload(1000), textPayload(63)}
+	for _, p := range payloads {
+		if err := cli.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if _, b, err := r.srv.Read(); err != nil || !bytes.Equal(b, p) {
+			t.Fatalf("Read returned %v bytes, %v", len(b), err)
+		}
+	}
+	sent := rec.messages(MsgDATA)
+	if len(sent) != 2 {
+		t.Fatalf("%v data messages sent", len(sent))
+	}
+	if p := sent[0].Payload; p[0] != codecLZW || len(p) >= 1000 {
+		t.Errorf("large payload sent with prefix %v in %v bytes", p[0], len(p))
+	}
+	if p := sent[1].Payload; p[0] != codecRaw || len(p) != 64 {
+		t.Errorf("small payload sent with prefix %v in %v bytes", p[0], len(p))
+	}
+}
@@ -0,0 +1,224 @@
+// Forward error correction.  With stop-and-wait, a lost data message
+// holds up its connection for an epoch, until it is sent again.  With
+// FEC on, each data message or bundle goes as k stripes of its payload,
+// plus a parity stripe holding their XOR, each in its own packet.  The
+// receiver rebuilds the message from any k of them, so it survives the
+// loss of one packet without a resend.  Acknowledgements, being small,
+// simply go twice.
+// Stripes also carry messages too large for the path MTU, with or
+// without FEC, as many as it takes for each to fit.  Without parity,
+// the receiver needs them all
+// Stripes share the message's sequence number.  Each starts with its
+// index, k, the message type and the payload length as a uvarint.
+// Index k is the parity stripe.  The last data stripe may be short, and
+// counts as padded with zeros
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"encoding/binary"
+	"fmt"
+)
+
+// Range for LspParams.FECStripes
+const (
+	MinFECStripes = 2
+	MaxFECStripes = 16
+)
+
+// Longest stripe header
+const maxStripeHeader = 3 + binary.MaxVarintLen64
+
+// Check stripe count, where 0 turns FEC off
+func checkFEC(stripes int) error {
+	if stripes != 0 && (stripes < MinFECStripes || stripes > MaxFECStripes) {
+		return lsplog.MakeErr(fmt.Sprintf("FECStripes must be 0, or from %v to %v",
+			MinFECStripes, MaxFECStripes))
+	}
+	return nil
+}
+
+// Stripe count from params, brought into range
+func fecStripes(params *LspParams) int {
+	if params.FECStripes <= 0 {
+		return 0
+	}
+	return min(max(params.FECStripes, MinFECStripes), MaxFECStripes)
+}
+
+// Number of data stripes message goes as, or 0 if it goes whole.
+// With FEC, at least the connection's stripe count.  Without, only when
+// message won't fit in a packet within the path MTU
+func (con *lspConn) stripesFor(m *LspMessage) int {
+	if !con.caps.FEC || (m.Type != MsgDATA && m.Type != MsgBUNDLE) || len(m.Payload) == 0 {
+		return 0
+	}
+	room := payloadRoom(con.packetLimit())
+	k := con.fec
+	if k == 0 {
+		if len(m.Payload) <= room {
+			return 0
+		}
+		k = MinFECStripes
+	}
+	for k < MaxFECStripes && maxStripeHeader + (len(m.Payload) + k - 1) / k > room {
+		k++
+	}
+	return k
+}
+
+// Room for payload of any one of k stripes of message
+func stripeRoom(m *LspMessage, k int) int {
+	return maxStripeHeader + (len(m.Payload) + k - 1) / k
+}
+
+// Stripe i of message split k ways, where i == k is parity.  Payload
+// goes in scratch, which must have stripeRoom bytes
+func stripeOf(scratch []byte, m *LspMessage, k, i int) LspMessage {
+	n := len(m.Payload)
+	size := (n + k - 1) / k
+	p := append(scratch[:0], byte(i), byte(k), m.Type)
+	p = binary.AppendUvarint(p, uint64(n))
+	if i < k {
+		p = append(p, m.Payload[min(i * size, n):min((i + 1) * size, n)]...)
+	} else {
+		parity := p[len(p):len(p) + size]
+		clear(parity)
+		for j := 0; j < k; j++ {
+			xorInto(parity, m.Payload[min(j * size, n):min((j + 1) * size, n)])
+		}
+		p = p[:len(p) + size]
+	}
+	return LspMessage{Type: MsgSTRIPE, ConnId: m.ConnId, SeqNum: m.SeqNum, Payload: p}
+}
+
+func xorInto(dst, src []byte) {
+	for i, c := range src {
+		dst[i] ^= c
+	}
+}
+
+// Stripe as found in packet
+type stripe struct {
+	index, k int
+	mtype byte
+	n int // Payload length of whole message
+	data []byte
+}
+
+// Parse stripe, checking that it is consistent with itself.
+// Returns false if not
+func parseStripe(m *LspMessage) (stripe, bool) {
+	var s stripe
+	p := m.Payload
+	if len(p) < 4 {
+		return s, false
+	}
+	s.index, s.k, s.mtype = int(p[0]), int(p[1]), p[2]
+	n, w := binary.Uvarint(p[3:])
+	if w <= 0 || n == 0 || n > uint64(MaxPayloadSize) {
+		return s, false
+	}
+	s.n, s.data = int(n), p[3 + w:]
+	if s.k < MinFECStripes || s.k > MaxFECStripes || s.index > s.k ||
+		(s.mtype != MsgDATA && s.mtype != MsgBUNDLE) {
+		return s, false
+	}
+	size := (s.n + s.k - 1) / s.k
+	want := size
+	if s.index < s.k {
+		want = min((s.index + 1) * size, s.n) - min(s.index * size, s.n)
+	}
+	return s, len(s.data) == want
+}
+
+// Take stripe of message with next sequence number, along with its
+// payload.  Returns message rebuilt from stripes once enough have
+// arrived, otherwise nil
+func (con *lspConn) addStripe(m *LspMessage) *LspMessage {
+	s, ok := parseStripe(m)
+	if !ok {
+		ReleasePayload(m.Payload)
+		releaseMessage(m)
+		return nil
+	}
+	if con.stripeCount > 0 {
+		first, _ := parseStripe(con.firstStripe())
+		if m.SeqNum != con.stripeSeq || s.k != first.k || s.n != first.n || s.mtype != first.mtype {
+			// Left over from earlier message, or sender changed FEC
+			con.dropStripes()
+		}
+	}
+	if con.stripeCount == 0 {
+		if cap(con.stripes) < s.k + 1 {
+			con.stripes = make([]*LspMessage, s.k + 1, MaxFECStripes + 1)
+		}
+		con.stripes = con.stripes[:s.k + 1]
+		con.stripeSeq = m.SeqNum
+	}
+	if con.stripes[s.index] != nil {
+		// Already have it
+		ReleasePayload(m.Payload)
+		releaseMessage(m)
+		return nil
+	}
+	con.stripes[s.index] = m
+	con.stripeCount++
+	if con.stripeCount < s.k {
+		return nil
+	}
+	// Enough to rebuild.  Fill in data stripes, noting any missing
+	size := (s.n + s.k - 1) / s.k
+	out := getPayload(s.n)[:s.n]
+	missing := -1
+	for j := 0; j < s.k; j++ {
+		if con.stripes[j] == nil {
+			missing = j
+			continue
+		}
+		d, _ := parseStripe(con.stripes[j])
+		copy(out[min(j * size, s.n):], d.data)
+	}
+	if missing >= 0 {
+		// XOR of parity with every other data stripe
+		hole := out[min(missing * size, s.n):min((missing + 1) * size, s.n)]
+		p, _ := parseStripe(con.stripes[s.k])
+		copy(hole, p.data)
+		for j := 0; j < s.k; j++ {
+			if j != missing {
+				lo, hi := min(j * size, s.n), min((j + 1) * size, s.n)
+				xorInto(hole, out[lo:min(hi, lo + len(hole))])
+			}
+		}
+		con.rebuilt++
+	}
+	rm := newMessage()
+	rm.Type = s.mtype
+	rm.ConnId = m.ConnId
+	rm.SeqNum = m.SeqNum
+	rm.Payload = out
+	con.dropStripes()
+	return rm
+}
+
+// Any stripe held
+func (con *lspConn) firstStripe() *LspMessage {
+	for _, m := range con.stripes {
+		if m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// Let go of stripes held
+func (con *lspConn) dropStripes() {
+	for i, m := range con.stripes {
+		if m != nil {
+			ReleasePayload(m.Payload)
+			releaseMessage(m)
+			con.stripes[i] = nil
+		}
+	}
+	con.stripeCount = 0
+}
@@ -0,0 +1,131 @@
+package lsp12
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+// Stripes of message split k ways, parity last
+func stripesOf(m *LspMessage, k int) []*LspMessage {
+	var stripes []*LspMessage
+	for i := 0; i <= k; i++ {
+		s := newMessage()
+		*s = stripeOf(getPayload(stripeRoom(m, k)), m, k, i)
+		stripes = append(stripes, s)
+	}
+	return stripes
+}
+
+// Message is rebuilt from any k of its k+1 stripes, whichever one is
+// lost, and whatever order the rest arrive in
+func TestStripeRebuild(t *testing.T) {
+	tests := []struct {
+		name string
+		k, n int
+	}{
+		{"even", 4, 1000},
+		{"short last stripe", 3, 1000},
+		{"fewer bytes than stripes", 3, 2},
+		{"one byte", 2, 1},
+		{"most stripes", MaxFECStripes, 999},
+	}
+	for _, tc := range tests {
+		payload := noisePayload(tc.n)
+		m := &LspMessage{Type: MsgDATA, ConnId: 1, SeqNum: 7, Payload: payload}
+		for lost := -1; lost <= tc.k; lost++ {
+			for _, reversed := range []bool{false, true} {
+				name := fmt.Sprintf("%s, stripe %v lost, reversed %v", tc.name, lost, reversed)
+				con := newConn(netip.AddrPort{}, 1, 0)
+				stripes := stripesOf(m, tc.k)
+				if lost >= 0 {
+					stripes = append(stripes[:lost], stripes[lost + 1:]...)
+				}
+				if reversed {
+					for i, j := 0, len(stripes) - 1; i < j; i, j = i + 1, j - 1 {
+						stripes[i], stripes[j] = stripes[j], stripes[i]
+					}
+				}
+				var rm *LspMessage
+				for i, s := range stripes[:tc.k] {
+					rm = con.addStripe(s)
+					if (rm != nil) != (i == tc.k - 1) {
+						t.Errorf("%s: message after %v stripes", name, i + 1)
+					}
+				}
+				if rm == nil || rm.Type != MsgDATA || rm.SeqNum != 7 || !bytes.Equal(rm.Payload, payload) {
+					t.Errorf("%s: rebuilt %v", name, rm)
+					continue
+				}
+				// Rebuilt from parity only when a data stripe is missing
+				want := 0
+				if lost >= 0 && lost < tc.k || lost < 0 && reversed {
+					want = 1
+				}
+				if con.rebuilt != want {
+					t.Errorf("%s: rebuilt count %v", name, con.rebuilt)
+				}
+			}
+		}
+	}
+}
+
+// Stripes that don't belong together, or make no sense, rebuild nothing
+func TestStripeMismatch(t *testing.T) {
+	con := newConn(netip.AddrPort{}, 1, 0)
+	m := &LspMessage{Type: MsgDATA, ConnId: 1, SeqNum: 1, Payload: noisePayload(100)}
+	old := stripesOf(m, 2)
+	m.SeqNum = 2
+	cur := stripesOf(m, 2)
+	if con.addStripe(old[0]) != nil || con.addStripe(cur[1]) != nil {
+		t.Fatalf("rebuilt from stripes of different messages")
+	}
+	bad := &LspMessage{Type: MsgSTRIPE, ConnId: 1, SeqNum: 2,
+		Payload: copyPayload([]byte{5, 2, MsgDATA, 100})}
+	if con.addStripe(bad) != nil {
+		t.Fatalf("rebuilt with stripe index beyond count")
+	}
+	if rm := con.addStripe(cur[2]); rm == nil || !bytes.Equal(rm.Payload, m.Payload) {
+		t.Errorf("rebuilt %v", rm)
+	}
+}
+
+// Transport dropping first stripe it sends with index 1
+type stripeLossTransport struct {
+	PacketTransport
+	dropped atomic.Bool
+}
+
+func (t *stripeLossTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	if m, _, err := extractMessage(b); err == nil && m.Type == MsgSTRIPE &&
+		len(m.Payload) > 0 && m.Payload[0] == 1 && t.dropped.CompareAndSwap(false, true) {
+		return len(b), nil
+	}
+	return t.PacketTransport.WriteTo(b, addr)
+}
+
+// Server rebuilds message with a lost stripe, without waiting for a resend
+func TestStripeLossOnWire(t *testing.T) {
+	params := &LspParams{EpochLimit: 5, EpochMilliseconds: 100, FECStripes: 4}
+	r := newRig(t, params, nil)
+	loss := &stripeLossTransport{}
+	cli := r.connect(params, func(pt PacketTransport) PacketTransport {
+		loss.PacketTransport = pt
+		return loss
+	})
+	payload := noisePayload(500)
+	if err := cli.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	r.step(func() {
+		if _, b, err := r.srv.Read(); err != nil || !bytes.Equal(b, payload) {
+			t.Errorf("Read returned %v bytes, %v", len(b), err)
+		}
+	})
+	conns := r.srv.Connections()
+	if !loss.dropped.Load() || len(conns) != 1 || conns[0].Rebuilt != 1 {
+		t.Errorf("dropped %v, connections %+v", loss.dropped.Load(), conns)
+	}
+}
@@ -0,0 +1,212 @@
+// Handing a running server over to a successor process.  The server's
+// connections are frozen and written out, so that the successor can pick
+// them up along with the UDP socket.  Clients see at most a few lost
+// packets, which the usual retransmissions cover.
+// The transfer itself is platform specific.  See handoff_unix.go
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"net/netip"
+)
+
+// Everything successor needs to carry on
+type handoffState struct {
+	Shards int `json:",omitempty"` // Absent from older versions
+	Conns []*handoffConn
+}
+
+// Connection state.  Timers are not carried over.  The successor
+// starts them afresh
+type handoffConn struct {
+	ConnId uint16
+	Addr netip.AddrPort
+	NextSendSeqNum byte
+	NextRecvSeqNum byte
+	LastAck *LspMessage `json:",omitempty"`
+	Caps *Capabilities `json:",omitempty"` // Absent from older versions
+	PathMTU int `json:",omitempty"` // As found by probing.  0 if not probing
+	FECStripes int `json:",omitempty"` // As set for connection.  0 if none
+	Pending *handoffMessage `json:",omitempty"` // Sent but not acknowledged
+	Queued []handoffMessage // Waiting to be sent, including close marker
+	Unread []*LspMessage // Acknowledged to client, but not yet read by application
+	ReadDone bool // Application has closed connection
+	WriteDone bool // Connection lost
+}
+
+// Message with what remains of its time to live
+type handoffMessage struct {
+	*LspMessage
+	TTL int64 `json:",omitempty"` // Epochs left.  0 if message never expires
+}
+
+// Stop passing received messages to application, so that it finishes
+// with what it has already read.  Writes continue
+func (srv *LspServer) hold() error {
+	for _, sh := range srv.shards {
+		if err := srv.tellShard(sh, msgHOLD); err != nil {
+			return err
+		}
+		<- sh.holdChan
+	}
+	close(srv.holding)
+	return nil
+}
+
+// Stop every shard, collecting its connections.  Server shuts down
+// once all shards have stopped, without touching the clients
+func (srv *LspServer) freeze() (*handoffState, error) {
+	state := &handoffState{Shards: len(srv.shards)}
+	for _, sh := range srv.shards {
+		if err := srv.tellShard(sh, msgHANDOFF); err != nil {
+			return nil, err
+		}
+		state.Conns = append(state.Conns, <- sh.handoffChan ...)
+	}
+	// Application may not have collected message that was handed over
+	select {
+	case m := <- srv.appReadChan:
+		for _, hc := range state.Conns {
+			if hc.ConnId == m.ConnId && m.Type == MsgDATA && !hc.ReadDone {
+				hc.Unread = append([]*LspMessage{m}, hc.Unread...)
+			}
+		}
+	default:
+	}
+	return state, nil
+}
+
+// Send request with no reply to shard
+func (srv *LspServer) tellShard(sh *serverShard, t byte) error {
+	m := newMessage()
+	m.Type = t
+	select {
+	case sh.appWriteChan <- m:
+		return nil
+	case <- sh.done:
+		releaseMessage(m)
+		return lsplog.ServerClosed()
+	}
+}
+
+// Successor keeps predecessor's shard count, since connection IDs map
+// to shards by it, as do the addresses of repeated connection requests
+func successorParams(params *LspParams, shards int) *LspParams {
+	if shards <= 0 {
+		return params
+	}
+	p := *withDefaults(params)
+	if p.ServerShards != shards {
+		lsplog.Vlogf(1, "Using predecessor's %v shards, not %v\n", shards, p.ServerShards)
+	}
+	p.ServerShards = shards
+	return &p
+}
+
+// Install connections from predecessor.  Must be called before
+// server is started
+func (srv *LspServer) thaw(state *handoffState) {
+	for _, hc := range state.Conns {
+		srv.shardForId(hc.ConnId).importConn(hc)
+	}
+}
+
+// Write out connections & stop loop.  Writes that are still waiting
+// for acknowledgement report that this server has closed, since their
+// fate now rests with the successor
+func (sh *serverShard) handOff() {
+	sh.Vlogf(1, "Handing off %v connections\n", len(sh.connById))
+	conns := make([]*handoffConn, 0, len(sh.connById))
+	byId := make(map[uint16] *handoffConn)
+	for id, con := range sh.connById {
+		hc := &handoffConn{
+			ConnId: id,
+			Addr: con.addr,
+			NextSendSeqNum: con.nextSendSeqNum,
+			NextRecvSeqNum: con.nextRecvSeqNum,
+			LastAck: con.lastAck,
+			Caps: &con.caps,
+			PathMTU: con.pathMTU,
+			FECStripes: con.fec,
+			ReadDone: con.readDoneFlag,
+			WriteDone: con.writeDoneFlag,
+		}
+		if con.pendingMsg != nil {
+			pm := sh.exportMessage(con, con.pendingMsg)
+			hc.Pending = &pm
+		}
+		for m := range con.sendBuf.All() {
+			hc.Queued = append(hc.Queued, sh.exportMessage(con, m))
+		}
+		conns = append(conns, hc)
+		byId[id] = hc
+	}
+	for m := range sh.readBuf.All() {
+		hc := byId[m.ConnId]
+		if m.Type == MsgDATA && hc != nil && !hc.ReadDone {
+			hc.Unread = append(hc.Unread, m)
+		}
+	}
+	sh.handoffChan <- conns
+	for _, con := range sh.connById {
+		con.failUnacked(lsplog.ServerClosed())
+	}
+	sh.stopFlag = true
+}
+
+// Message with time to live in connection's epochs, rounded up
+func (sh *serverShard) exportMessage(con *lspConn, m *LspMessage) handoffMessage {
+	hm := handoffMessage{LspMessage: m}
+	if m.expires != 0 {
+		left := m.expires - sh.currentEpoch
+		hm.TTL = max((left + con.epochTicks - 1) / con.epochTicks, 1)
+	}
+	return hm
+}
+
+// Recreate connection handed over by predecessor
+func (sh *serverShard) importConn(hc *handoffConn) {
+	caps := legacyCapabilities()
+	if hc.Caps != nil {
+		caps = *hc.Caps
+	}
+	con := sh.newServerConn(hc.Addr, hc.ConnId, caps)
+	con.fec = hc.FECStripes
+	if hc.PathMTU > 0 {
+		// Search starts by checking that path still takes it
+		con.pathMTU = hc.PathMTU
+		con.mtuConfirmed = false
+	}
+	con.nextSendSeqNum = hc.NextSendSeqNum
+	con.nextRecvSeqNum = hc.NextRecvSeqNum
+	con.lastAck = hc.LastAck
+	sh.connById[con.connId] = con
+	sh.connByAddr[con.addr] = con
+	for _, m := range hc.Unread {
+		sh.readBuf.Insert(m)
+	}
+	if hc.Pending != nil {
+		pm := hc.Pending.LspMessage
+		pm.expires = hc.Pending.TTL
+		// Treat as if just queued, then put straight back in flight
+		con.queue(pm, sh.currentEpoch)
+		con.pendingMsg = con.sendBuf.Remove()
+		sh.timers.schedule(con.resendTimer, sh.resendDeadline(con))
+	}
+	for _, qm := range hc.Queued {
+		qm.expires = qm.TTL
+		con.queue(qm.LspMessage, sh.currentEpoch)
+	}
+	if con.nextExpiry != 0 {
+		sh.timers.schedule(con.expireTimer, con.nextExpiry)
+	}
+	if hc.ReadDone {
+		con.readDoneFlag = true
+		con.closeErr = lsplog.ConnectionClosed(con.connId)
+	}
+	if hc.WriteDone {
+		con.closeErr = lsplog.ConnectionLost(con.connId, lsplog.ErrTimeout)
+		sh.writeDone(con)
+	}
+	sh.Vlogf(3, "Took over connection %v to %v\n", con.connId, con.addr)
+}
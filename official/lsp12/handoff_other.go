@@ -0,0 +1,16 @@
+//go:build !unix
+
+// Handoff needs descriptor passing over Unix sockets
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+)
+
+func (srv *LspServer) iHandOff(path string) error {
+	return lsplog.NotImplemented("HandOff")
+}
+
+func iNewLspServerFrom(path string, params *LspParams) (*LspServer, error) {
+	return nil, lsplog.NotImplemented("NewLspServerFrom")
+}
@@ -0,0 +1,135 @@
+//go:build unix
+
+package lsp12
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Rig with server on loopback UDP socket, which handoff can pass on
+func newUDPRig(t *testing.T, params *LspParams) *testRig {
+	st, err := ListenUDPTransport("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := st.LocalAddr().String()
+	return newRigOver(t, params, st, func() (PacketTransport, error) {
+		return DialUDPTransport("udp", addr)
+	})
+}
+
+// Hand rig's server over to a successor, which rig then uses
+func (r *testRig) handOff(params *LspParams) error {
+	return r.handOffAt(filepath.Join(r.t.TempDir(), "handoff.sock"), params)
+}
+
+func (r *testRig) handOffAt(path string, params *LspParams) error {
+	herr := make(chan error, 1)
+	go func() { herr <- r.srv.HandOff(path) }()
+	// Server holds once it is listening for successor
+	select {
+	case <-r.srv.holding:
+	case err := <-herr:
+		return err
+	}
+	succ, err := NewLspServerFrom(path, params)
+	if err != nil {
+		<-herr
+		return err
+	}
+	r.srv = succ
+	return <-herr
+}
+
+// Draining server can still be handed off, which ends the drain
+func TestDrainThenHandOff(t *testing.T) {
+	params := &LspParams{EpochLimit: 5, EpochMilliseconds: 100, ServerShards: 2}
+	r := newUDPRig(t, params)
+	cli := r.connect(params, nil)
+	drained := r.srv.Drain(0)
+	if err := r.handOff(params); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+	default:
+		t.Errorf("drain still waiting after handoff")
+	}
+	// Client carries on with successor
+	if err := cli.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if id, b, err := r.srv.Read(); err != nil || id != cli.ConnId() || string(b) != "after" {
+		t.Errorf("successor read %v %q %v", id, b, err)
+	}
+}
+
+// Successor carries on where predecessor left off: message received
+// but not yet read, message sent but not acknowledged, and message
+// still queued behind it
+func TestHandOffRoundTrip(t *testing.T) {
+	params := &LspParams{EpochLimit: 5, EpochMilliseconds: 100, ServerShards: 2}
+	r := newUDPRig(t, params)
+	// Client's acknowledgements held back until after handoff
+	var mt *muteTransport
+	quiet := r.connect(params, func(t PacketTransport) PacketTransport {
+		mt = &muteTransport{PacketTransport: t}
+		mt.left.Store(1)
+		return mt
+	})
+	chatty := r.connect(params, nil)
+	if err := chatty.Write([]byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chatty.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"pending", "queued"} {
+		if err := r.srv.Write(quiet.ConnId(), []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := quiet.Read(); err != nil || string(b) != "pending" {
+		t.Fatalf("client read %q, %v", b, err)
+	}
+	if err := r.handOff(params); err != nil {
+		t.Fatal(err)
+	}
+	if id, b, err := r.srv.Read(); err != nil || id != chatty.ConnId() || string(b) != "unread" {
+		t.Errorf("successor read %v %q %v", id, b, err)
+	}
+	// One epoch has client repeat its acknowledgement, which lets
+	// successor send next message.  More would outrun real packets
+	mt.left.Store(1 << 30)
+	r.epochs(1)
+	if b, err := quiet.Read(); err != nil || string(b) != "queued" {
+		t.Errorf("client read %q, %v", b, err)
+	}
+	if conns := r.srv.Connections(); len(conns) != 2 {
+		t.Errorf("successor has connections %+v", conns)
+	}
+}
+
+// Handoff clears out old socket at path, but refuses to touch anything
+// else there
+func TestHandOffKeepsFile(t *testing.T) {
+	params := &LspParams{EpochLimit: 5, EpochMilliseconds: 100, ServerShards: 1}
+	r := newUDPRig(t, params)
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	if err := os.WriteFile(path, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.srv.HandOff(path); err == nil {
+		t.Fatalf("handoff over regular file succeeded")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "keep" {
+		t.Errorf("file now holds %q, %v", b, err)
+	}
+	// Server carries on, and can still hand off once path is free
+	os.Remove(path)
+	if err := r.handOffAt(path, params); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build unix
+
+// Handoff transfer over a Unix socket.  Predecessor listens and sends
+// connection state as JSON, with the UDP socket attached as SCM_RIGHTS.
+// Successor replies with a single byte once it has taken over
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"P3-f12/official/lspnet"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+func (srv *LspServer) iHandOff(path string) (err error) {
+	// Only a UDP socket can be passed on
+	ut, ok := srv.transport.(*udpTransport)
+	if !ok {
+		return lsplog.NotImplemented("HandOff over non-UDP transport")
+	}
+	// Clear out socket left by an earlier handoff, but nothing else
+	if fi, err := os.Lstat(path); err == nil && fi.Mode() & os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if lsplog.CheckReport(1, err) {
+		return err
+	}
+	defer l.Close()
+	if err := srv.hold(); err != nil {
+		return err
+	}
+	// From here on, failure leaves server shut down
+	defer func() {
+		if err != nil {
+			srv.iCloseAll()
+		}
+	}()
+	c, err := l.AcceptUnix()
+	if lsplog.CheckReport(1, err) {
+		return err
+	}
+	defer c.Close()
+	srv.Vlogf(1, "Successor connected.  Handing off\n")
+
+	// Duplicate socket first, since it gets closed once shards stop
+	f, err := ut.conn.File()
+	if lsplog.CheckReport(1, err) {
+		return err
+	}
+	defer f.Close()
+	state, err := srv.freeze()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if lsplog.CheckReport(1, err) {
+		return err
+	}
+	// Fd() would switch socket to blocking mode.  Borrow descriptor instead
+	rc, err := f.SyscallConn()
+	if lsplog.CheckReport(1, err) {
+		return err
+	}
+	var werr error
+	var n int
+	err = rc.Control(func(fd uintptr) {
+		n, _, werr = c.WriteMsgUnix(data, syscall.UnixRights(int(fd)), nil)
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil && n < len(data) {
+		// Stream socket takes large state a piece at a time
+		_, err = c.Write(data[n:])
+	}
+	if lsplog.CheckReport(1, err) {
+		return err
+	}
+	c.CloseWrite()
+	// Wait for successor to confirm
+	var ack [1]byte
+	if _, rerr := io.ReadFull(c, ack[:]); rerr != nil {
+		lsplog.CheckReport(1, rerr)
+		return lsplog.MakeErr("Successor failed to take over")
+	}
+	<- srv.closed
+	srv.goroutines.Wait()
+	srv.Vlogf(1, "Handoff of %v connections complete\n", len(state.Conns))
+	return nil
+}
+
+func iNewLspServerFrom(path string, params *LspParams) (*LspServer, error) {
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if lsplog.CheckReport(1, err) {
+		return nil, err
+	}
+	defer c.Close()
+	buf := make([]byte, 64 << 10)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+	if lsplog.CheckReport(1, err) {
+		return nil, err
+	}
+	f, err := receivedFile(oob[:oobn])
+	if lsplog.CheckReport(1, err) {
+		return nil, err
+	}
+	udpConn, err := lspnet.FileUDPConn(f)
+	f.Close()
+	if lsplog.CheckReport(1, err) {
+		return nil, err
+	}
+	// Rest of state follows descriptor
+	rest, err := io.ReadAll(c)
+	if err == nil {
+		var state handoffState
+		err = json.Unmarshal(append(buf[:n], rest...), &state)
+		if err == nil {
+			srv := newLspServer(&udpTransport{conn: udpConn}, successorParams(params, state.Shards))
+			srv.thaw(&state)
+			srv.start()
+			c.Write([]byte{1})
+			srv.Vlogf(1, "Took over %v connections\n", len(state.Conns))
+			return srv, nil
+		}
+	}
+	lsplog.CheckReport(1, err)
+	udpConn.Close()
+	return nil, err
+}
+
+// Extract descriptor passed with message
+func receivedFile(oob []byte) (*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, lsplog.MakeErr("No socket received from predecessor")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, lsplog.MakeErr("No socket received from predecessor")
+	}
+	return os.NewFile(uintptr(fds[0]), "lsp-handoff"), nil
+}
@@ -8,6 +8,12 @@
 
 package lsp12
 
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
 // Define operational parameters for LSP client or server
 // Parameter structure used when initializing either a client or a server
 type LspParams struct {
@@ -17,6 +23,131 @@ type LspParams struct {
 	// How many milliseconds between epochs
 	// When 0, use default value (2000)
 	EpochMilliseconds int
+	// How many event loops share a server's connections (server only)
+	// When 0, use one per processor (GOMAXPROCS)
+	ServerShards int
+	// How many epochs a written message may wait to be acknowledged
+	// before it is dropped.  When 0, messages never expire.  A message
+	// already sent to a peer speaking protocol version 1 is not dropped.
+	// Drops are logged at level 2, and counted in ConnInfo.Expired
+	MessageTTL int
+	// Largest payload to accept.  When 0, or more than fits in a
+	// packet, MaxPayloadSize
+	MaxPayload int
+	// Server only.  Range of epoch lengths & limits that clients may
+	// propose.  Proposals outside the range are clamped to it.  When
+	// both ends of a range are 0, clients get the server's own
+	// EpochMilliseconds or EpochLimit.  With a range of epoch lengths,
+	// the server times connections in ticks of a tenth of the shorter
+	// of MinEpochMilliseconds and EpochMilliseconds, and rounds the
+	// lengths it agrees to whole ticks
+	MinEpochMilliseconds, MaxEpochMilliseconds int
+	MinEpochLimit, MaxEpochLimit int
+	// Compression codecs to offer or accept, in order of preference:
+	// CompressionDeflate or CompressionLZW.  When nil, or the other end
+	// supports none of them, payloads are sent as written.  With
+	// compression, the largest payload is one byte less than
+	// MaxPayloadSize
+	Compression []string
+	// Payloads shorter than this are sent uncompressed.  When 0, 128 bytes
+	CompressMinSize int
+	// Coalescing, used when both ends support it.  Data messages queued
+	// behind one awaiting acknowledgement are bundled into one packet,
+	// and acknowledgements ride along with data going the same way.
+	// When CoalesceMilliseconds > 0, a message written with nothing ahead
+	// of it, and any acknowledgement, waits up to that long for company.
+	// NoDelay sends each message in its own packet as soon as it can,
+	// for latency-sensitive traffic.  On a server, it applies to new
+	// connections, and SetNoDelay changes it for one connection
+	CoalesceMilliseconds int
+	NoDelay bool
+	// Forward error correction, used when both ends support it.  Each
+	// data message goes as this many stripes plus one of parity, so that
+	// the other end can rebuild it when any one packet is lost, without
+	// waiting an epoch for a resend.  Costs about 1/FECStripes more
+	// bandwidth, and more packets.  0 for none, or from MinFECStripes to
+	// MaxFECStripes.  On a server, it applies to new connections, and
+	// SetFEC changes it for one connection
+	FECStripes int
+	// Lowest protocol version to accept from other end.  When 0,
+	// accept any, including peers that don't negotiate (version 1)
+	MinVersion int
+	// Source of epochs.  When nil, use real time.  Tests can supply a
+	// ManualClock to step through epochs without waiting
+	Clock Clock
+}
+
+// Protocol version & features.  Client offers what it supports in its
+// connection request, and server replies with what both support.
+// Implementation file: capabilities.go
+type Capabilities struct {
+	Version int // Protocol version.  In offer, the highest supported
+	MinVersion int `json:",omitempty"` // Offer only.  Lowest version supported
+	// Feature names in order of preference.  Once agreed, encoding has
+	// one entry, and the others at most one
+	Encodings []string
+	Compression []string `json:",omitempty"`
+	Encryption []string `json:",omitempty"`
+	Window int // Most messages in flight at once
+	MaxPayload int // Largest payload in bytes
+	// Timing.  Client proposes its own, and server replies with what
+	// both ends will use for this connection
+	EpochMilliseconds int `json:",omitempty"`
+	EpochLimit int `json:",omitempty"`
+	// Can take packets holding several messages, and bundles
+	Coalesce bool `json:",omitempty"`
+	// Answers path MTU probes
+	PathProbe bool `json:",omitempty"`
+	// Can rebuild messages from parity stripes
+	FEC bool `json:",omitempty"`
+}
+
+// Time source.  Implementation file: clock.go
+type Clock interface {
+	Now() time.Time
+	// Channel that delivers a tick every d, and function that stops it
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// Options for a single write
+type WriteOptions struct {
+	// Where to report outcome, as for WriteNotify.  nil if not wanted
+	Done chan error
+	// How many epochs message may wait to be acknowledged before it is
+	// dropped, reporting lsplog.ErrExpired on Done.  A message dropped
+	// after being sent may still have been delivered.
+	// When 0, use LspParams.MessageTTL.  When negative, never expire
+	TTL int
+}
+
+// Options for connecting client.  Zero value connects as NewLspClient does
+type DialOptions struct {
+	// Longest to spend connecting, across all addresses.  The time left
+	// is shared equally among the addresses still to try.
+	// When 0, each address gets EpochLimit epochs
+	Timeout time.Duration
+	// Resend connection request after RetryInterval, doubling the
+	// interval after each resend, up to MaxRetryInterval if that is set.
+	// When 0, resend once each epoch
+	RetryInterval, MaxRetryInterval time.Duration
+	// Servers to try in turn when the previous one refuses, can't be
+	// reached or doesn't answer in time
+	Alternates []string
+}
+
+// Carries packets between client and server.  Implementation file:
+// transport.go, with UDP (default), Unix datagram and in-memory versions.
+// Peers are identified by address and port.  Transports without IP
+// addresses give each peer a stable synthetic one.
+// A client's transport is connected to the server: it ignores the
+// address passed to WriteTo.
+// Must be safe for concurrent use.  Once Close is called, ReadFrom
+// must return an error
+type PacketTransport interface {
+	ReadFrom(b []byte) (n int, addr netip.AddrPort, err error)
+	WriteTo(b []byte, addr netip.AddrPort) (n int, err error)
+	LocalAddr() net.Addr
+	Close() error
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -32,6 +163,10 @@ const (
 	MsgDATA             // Data 
 	MsgACK              // Acknowledge connection request, data, or close
 	MsgINVALID          // Invalid message
+	MsgSKIP             // Stands in for expired data message, so sequence has no gap
+	MsgBUNDLE           // Several data messages sharing one sequence number
+	MsgPROBE            // Path MTU probe, padded to size.  Answered without payload
+	MsgSTRIPE           // Part of data message or bundle, or parity, for FEC
 )
 
 // Program representation of message contained within packet
@@ -41,6 +176,10 @@ type LspMessage struct {
 	ConnId uint16  // Connection ID
 	SeqNum byte    // Sequence number (wraps around)
 	Payload []byte // Messsage payload (nil for Connect or Ack messages)
+	notify chan error // Where to report acknowledgement.  Not sent over network
+	expires int64 // Epoch at which message is dropped, or 0.  Not sent over network
+	parts []*LspMessage // Data messages in bundle.  Not sent over network
+	err error // Why reads fail, in marker that ends them.  Not sent over network
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -55,10 +194,47 @@ type LspClient struct {
 	iLspClient  // Private fields
 }
 
+// Where client is in its lifetime
+type ClientState int
+
+const (
+	ClientConnecting ClientState = iota // Waiting for server to accept
+	ClientConnected                     // Reading & writing
+	ClientClosing                       // Close called.  Remaining writes still being sent
+	ClientLost                          // Contact lost, or refused by server
+	ClientClosed                        // Closed by application
+)
+
+// Client state, as sent to subscribers
+type ClientStatus struct {
+	State ClientState
+	// Epochs that have passed without hearing from server.  The
+	// connection is lost once this reaches EpochLimit
+	SilentEpochs int
+	EpochLimit int
+	Err error // Why connection was lost
+}
+
 // Initiate a connection to host and set up application client
 // Call returns only after connection established
 func NewLspClient(hostport string, params *LspParams) (*LspClient, error) {
-	return iNewLspClient(hostport, params)
+	return iDialLspClient(hostport, params, DialOptions{})
+}
+
+// Connect to server at hostport, or one of opts.Alternates.
+// Call returns only after connection established.  Otherwise the error
+// is from the last address tried, and wraps lsplog.ErrConnectionRefused
+// if the host refused, lsplog.ErrUnreachable if it couldn't be reached,
+// or lsplog.ErrTimeout if it never answered
+func DialLspClient(hostport string, params *LspParams, opts DialOptions) (*LspClient, error) {
+	return iDialLspClient(hostport, params, opts)
+}
+
+// Set up client over transport t, which must be connected to server
+// Call returns only after connection established.  Client closes t
+// when done, including when connection fails
+func NewLspClientTransport(t PacketTransport, params *LspParams) (*LspClient, error) {
+	return iNewLspClientTransport(t, params)
 }
 
 // Return the Connection ID for a client
@@ -66,18 +242,97 @@ func (cli *LspClient) ConnId() uint16 {
 	return cli.iConnId()
 }
 
+// Return what client & server agreed on when connecting
+func (cli *LspClient) Capabilities() Capabilities {
+	return cli.iCapabilities()
+}
+
+// Return largest packet known to reach server, in bytes, as found by
+// probing.  Before probing has confirmed anything, a size that gets
+// through nearly any path.  When server doesn't answer probes,
+// the largest packet LSP sends
+func (cli *LspClient) PathMTU() int {
+	return cli.iPathMTU()
+}
+
+// Return where client is in its lifetime
+func (cli *LspClient) State() ClientState {
+	return cli.iState()
+}
+
+// Subscribe to changes in client state.  The channel receives the
+// current status at once, then each change, including each epoch that
+// passes without hearing from the server.  It holds only the latest
+// status, so a slow reader misses intermediate ones but never the last.
+// The channel is closed once the client has finished, or when the
+// returned function is called
+func (cli *LspClient) Subscribe() (<-chan ClientStatus, func()) {
+	return cli.iSubscribe()
+}
+
+// Change client's parameters while it runs.  Epoch length & limit take
+// effect at once.  The server keeps timing the connection as agreed when
+// connecting, so a client that slows its epochs well beyond that may be
+// declared lost.  Clock can't change
+func (cli *LspClient) SetParams(params *LspParams) error {
+	return cli.iSetParams(params)
+}
+
+// Choose whether to send each message in its own packet as soon as
+// possible, as with LspParams.NoDelay
+func (cli *LspClient) SetNoDelay(noDelay bool) error {
+	return cli.iSetNoDelay(noDelay)
+}
+
+// Change forward error correction for messages to server, as with
+// LspParams.FECStripes.  Fails if server doesn't support it
+func (cli *LspClient) SetFEC(stripes int) error {
+	return cli.iSetFEC(stripes)
+}
+
+// Return the local address that client sends from
+func (cli *LspClient) LocalAddr() net.Addr {
+	return cli.iLocalAddr()
+}
+
 // Read message from server.  Non-nil error indicates that connection
-// to server is permanently lost
+// to server is permanently lost.  Loss of contact wraps both
+// lsplog.ErrConnectionLost and lsplog.ErrTimeout
 // Call blocks until value available to read, or network disconnected
+// Payload belongs to the caller.  It may be handed back with ReleasePayload
 func (cli *LspClient) Read() ([]byte, error) {
 	return cli.iRead()
 }
 
 // Write message to server.  Non-nil error indicates that connection
 // to server is permanently lost.
+// Payloads longer than MaxPayloadSize are refused.
 // Call does not block
+// Payload is copied, so caller may reuse it once call returns
 func (cli *LspClient) Write(payload []byte) error {
-	return cli.iWrite(payload)
+	return cli.iWrite(payload, WriteOptions{})
+}
+
+// Write message to server, as with Write.  Once the server acknowledges
+// the message, nil is sent on done.  If the connection ends first, the
+// error is sent instead.  Nothing is sent if WriteNotify returns an error.
+// done must be buffered, with room for the outcome of every write still
+// outstanding on it, or WriteNotify fails with lsplog.ErrNoRoom.  Room
+// is held from the write until its outcome is sent, so sending never
+// blocks and no outcome is lost
+func (cli *LspClient) WriteNotify(payload []byte, done chan error) error {
+	return cli.iWrite(payload, WriteOptions{Done: done})
+}
+
+// Write message to server, as with Write, using specified options
+func (cli *LspClient) WriteWith(payload []byte, opts WriteOptions) error {
+	return cli.iWrite(payload, opts)
+}
+
+// Block until server has acknowledged every message written so far.
+// Non-nil error indicates that connection ended first
+func (cli *LspClient) Flush() error {
+	return cli.iFlush()
 }
 
 // Terminate client.
@@ -100,12 +355,111 @@ type LspServer struct {
 	iLspServer // Private fields
 }
 
+// Where connection is in shutting down.  Both halves done means gone
+type ConnState int
+
+const (
+	ConnOpen ConnState = iota // Reading & writing
+	ConnReadDone              // Application closed it.  Remaining writes still being sent
+	ConnWriteDone             // Lost.  Loss not yet passed on to application
+)
+
+// Snapshot of one connection, as reported by Connections
+type ConnInfo struct {
+	ConnId uint16
+	RemoteAddr netip.AddrPort
+	State ConnState
+	SinceHeard int64 // Epochs since anything was heard from client
+	Queued int // Messages waiting to be sent
+	Pending int // Messages sent but not yet acknowledged
+	PathMTU int // Largest packet known, or assumed, to reach client, in bytes
+	Resent int // Times a message was sent again for want of acknowledgement
+	Rebuilt int // Messages from client rebuilt from parity, without a resend
+	Expired int // Writes to client dropped because their time to live ran out
+}
+
+// Counts kept by server as a whole, since it started
+type ServerStats struct {
+	BadSource int64 // Packets dropped because source didn't match connection
+	OutOfIds int64 // Connection requests refused because shard had no IDs left
+}
+
 // Set up an application server on specified port.
 // Call returns once server ready to accept connection requests
 func NewLspServer(port int, params *LspParams) (*LspServer, error) {
 	return iNewLspServer(port, params)
 }
 
+// Set up an application server listening on address, in "host:port"
+// form.  An empty host means all interfaces, and port 0 picks a free
+// port, which LocalAddr reports.  network is "udp", or "udp4" or "udp6"
+// to restrict server to IPv4 or IPv6.
+// Call returns once server ready to accept connection requests
+func NewLspServerAddr(network, address string, params *LspParams) (*LspServer, error) {
+	return iNewLspServerAddr(network, address, params)
+}
+
+// Set up server over transport t, which it closes when done
+func NewLspServerTransport(t PacketTransport, params *LspParams) *LspServer {
+	return iNewLspServerTransport(t, params)
+}
+
+// Return the address that server is listening on
+func (srv *LspServer) LocalAddr() net.Addr {
+	return srv.iLocalAddr()
+}
+
+// Return what server agreed with client on connection connId
+func (srv *LspServer) Capabilities(connId uint16) (Capabilities, error) {
+	return srv.iCapabilities(connId)
+}
+
+// Return address of client on connection connId
+func (srv *LspServer) RemoteAddr(connId uint16) (netip.AddrPort, error) {
+	return srv.iRemoteAddr(connId)
+}
+
+// Return snapshot of every connection, in order of connection ID
+func (srv *LspServer) Connections() []ConnInfo {
+	return srv.iConnections()
+}
+
+// Return counts kept by server across all connections
+func (srv *LspServer) Stats() ServerStats {
+	return srv.iStats()
+}
+
+// Choose whether to send each message to client on connection connId
+// in its own packet as soon as possible, as with LspParams.NoDelay
+func (srv *LspServer) SetNoDelay(connId uint16, noDelay bool) error {
+	return srv.iSetNoDelay(connId, noDelay)
+}
+
+// Change forward error correction for messages to client on connection
+// connId, as with LspParams.FECStripes.  Fails if client doesn't
+// support it
+func (srv *LspServer) SetFEC(connId uint16, stripes int) error {
+	return srv.iSetFEC(connId, stripes)
+}
+
+// Change server's parameters while it runs, without dropping
+// connections.  New connections are negotiated under the new
+// parameters.  Existing ones keep the epoch length agreed with their
+// clients, but take up the new epoch limit.  ServerShards and Clock
+// can't change, though ServerShards may be left 0
+func (srv *LspServer) SetParams(params *LspParams) error {
+	return srv.iSetParams(params)
+}
+
+// Take over server from predecessor that is calling HandOff with
+// the same path.
+// Call returns once server ready, with predecessor's connections.
+// Server keeps predecessor's number of shards, whatever ServerShards says.
+// Only supported on Unix systems
+func NewLspServerFrom(path string, params *LspParams) (*LspServer, error) {
+	return iNewLspServerFrom(path, params)
+}
+
 // Read next message received by server, return connection ID + contents.
 //
 // When connection ID > 0 & error non-nil, this indicates that the
@@ -114,7 +468,11 @@ func NewLspServer(port int, params *LspParams) (*LspServer, error) {
 // When connection ID == 0 & error non-nil, then server is no longer
 // operational
 //
+// Errors wrap the sentinels in lsplog (ErrConnectionLost, ErrServerClosed, ...)
+// and can be tested with errors.Is.
+//
 // Call blocks until value available to read, or network disconnected
+// Payload belongs to the caller.  It may be handed back with ReleasePayload
 func (srv *LspServer) Read() (uint16, []byte, error) {
 	return srv.iRead()
 }
@@ -125,9 +483,32 @@ func (srv *LspServer) Read() (uint16, []byte, error) {
 //
 // Any attempt to send message with connID == 0
 // will be ignored, with non-nil error value returned.
+// Likewise for a connection that is unknown, closing, or closed,
+// or once CloseAll has been called, and for payloads longer than
+// MaxPayloadSize.
 // Call does not block
+// Payload is copied, so caller may reuse it once call returns
 func (srv *LspServer) Write(connId uint16, payload []byte) error {
-	return srv.iWrite(connId, payload)
+	return srv.iWrite(connId, payload, WriteOptions{})
+}
+
+// Write message to specified client, as with Write.  Once the client
+// acknowledges the message, nil is sent on done.  If the connection ends
+// first, the error is sent instead.  Nothing is sent if WriteNotify
+// returns an error.  done needs room as for LspClient.WriteNotify
+func (srv *LspServer) WriteNotify(connId uint16, payload []byte, done chan error) error {
+	return srv.iWrite(connId, payload, WriteOptions{Done: done})
+}
+
+// Write message to specified client, as with Write, using specified options
+func (srv *LspServer) WriteWith(connId uint16, payload []byte, opts WriteOptions) error {
+	return srv.iWrite(connId, payload, opts)
+}
+
+// Block until specified client has acknowledged every message written
+// to it so far.  Non-nil error indicates that connection ended first
+func (srv *LspServer) Flush(connId uint16) error {
+	return srv.iFlush(connId)
 }
 
 // Close only specified connection.
@@ -140,6 +521,34 @@ func (srv *LspServer) CloseConn(connId uint16) {
 	srv.iCloseConn(connId)
 }
 
+// Stop accepting connections, refusing any further requests, while
+// existing connections carry on until they close.  The returned channel
+// is closed once the last one has gone, or server has handed off.
+// When epochs > 0, connections still open after that many epochs are
+// closed, as with CloseConn.  Calling again replaces any earlier
+// deadline, counting from the new call, and epochs of 0 removes it.
+// Call does not block.  Server keeps running until CloseAll is called
+func (srv *LspServer) Drain(epochs int) <-chan struct{} {
+	return srv.iDrain(epochs)
+}
+
+// Hand server over to a successor process on the same host, which
+// calls NewLspServerFrom with the same path.  Listens on a Unix socket
+// at path, replacing any stale socket there but no other kind of file,
+// until the successor connects, then passes it the UDP socket
+// along with every connection, and shuts this server down.  Clients
+// carry on with the successor.
+// Once called, Read reports that the server has closed, while Write
+// keeps working until the successor connects, so that the application
+// can answer what it has already read.  Writes still awaiting acknowledgement
+// report lsplog.ErrServerClosed, since the successor takes them over.
+// Call blocks until handoff complete.  If it fails part way,
+// the server is left shut down.
+// Only supported on Unix systems, for servers running over UDP
+func (srv *LspServer) HandOff(path string) error {
+	return srv.iHandOff(path)
+}
+
 // Close all connections and terminate server
 // Call returns after all pending messages to active clients have been sent
 // Application should not attempt to call Read, Write, CloseConn, or CloseAll
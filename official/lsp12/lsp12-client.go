@@ -2,8 +2,12 @@ package lsp12
 
 import (
 	"P3-f12/official/lsplog"
-	"P3-f12/official/lspnet"
 	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,46 +19,496 @@ type LspMessageChan chan *LspMessage
 
 // All information associated with single client
 type lspConn struct {
-	addr *lspnet.UDPAddr // Address of other end of connection
+	addr netip.AddrPort // Address of other end of connection
 	connId  uint16  // Connection ID
-	sendBuf *Buf   // Messages queued to send
+	sendBuf *Queue[*LspMessage] // Messages queued to send
 	pendingMsg *LspMessage // Message that has been sent, but not yet ack'ed
 	lastAck *LspMessage // Last ack sent
 	nextSendSeqNum byte
 	nextRecvSeqNum byte
 	lastHeardEpoch int64
 	// Have network operations stopped for this connection?
+	// Only touched by event loop.  Other goroutines watch a done channel
 	stopNetworkFlag bool
 	// Flags to support connection shutdown on server
 	readDoneFlag  bool // Have all reads been completed
 	writeDoneFlag bool // Have all writes been completed
+	closeErr error // Returned to writes once connection has ended
+	flushWaiters *Queue[chan error] // Flushes waiting for acknowledgements
+	nextExpiry int64 // Earliest epoch at which a message expires, or 0
+	caps Capabilities // Agreed when connecting
+	codec byte // Agreed compression codec.  0 if payloads have no prefix
+	compressMin int // Shortest payload to compress
+	// Coalescing
+	coalesce bool // Other end takes bundles & shared datagrams
+	noDelay bool // Send each message in own packet, at once
+	holdData bool // Waiting for more data before sending
+	ackDue bool // Acknowledgement held back, to share datagram with data
+	held bool // Has output held back
+	unbundled []*LspMessage // Scratch space for splitting bundles
+	// Path MTU discovery
+	pathMTU int // Largest packet known to reach other end.  0 if not probing
+	mtuConfirmed bool // pathMTU has been confirmed by this search
+	probeHi int // Smallest packet known not to get through
+	probeSize int // Size of probe awaiting answer, or 0
+	probeSeq byte // Sequence number of latest probe
+	probeTried int // Times probe has been sent
+	probeAt int64 // Epoch at which to give up on probe, or start next search
+	// Forward error correction
+	fec int // Data stripes per message sent.  0 if none
+	stripes []*LspMessage // Stripes received of next message, by index
+	stripeCount int // How many of them there are
+	stripeSeq byte // Sequence number of message they belong to
+	resent int // Messages sent again
+	rebuilt int // Messages rebuilt using parity
+	expired int // Writes dropped because their time to live ran out
+	epochLimit int // Epochs without hearing from other end before giving up
+	epochTicks int64 // Length of connection's epoch, in epochs of event loop
+	// Server-side timers
+	liveTimer *wheelTimer   // Fires when epoch limit exceeded
+	resendTimer *wheelTimer // Fires when pending message due for resend
+	expireTimer *wheelTimer // Fires when a queued message expires
+	probeTimer *wheelTimer // Fires when path MTU probe is due
 }
 
-func newConn(addr *lspnet.UDPAddr, connId uint16, epoch int64) *lspConn {
+func newConn(addr netip.AddrPort, connId uint16, epoch int64) *lspConn {
 	con := new(lspConn)
 	con.addr = addr
 	con.connId = connId
-	con.sendBuf = NewBuf()
+	con.sendBuf = NewQueue[*LspMessage](0)
+	con.flushWaiters = NewQueue[chan error](0)
 	con.pendingMsg = nil
 	con.lastAck = nil
 	con.nextSendSeqNum = 0
 	con.nextRecvSeqNum = 0
 	con.lastHeardEpoch = epoch
+	con.epochTicks = 1
 	return con
 }
 
+// Set up acknowledgement for sequence number.  Reuses previous one
+func (con *lspConn) setAck(seqnum byte) {
+	if con.lastAck == nil {
+		con.lastAck = new(LspMessage)
+	}
+	*con.lastAck = LspMessage{Type: MsgACK, ConnId: con.connId, SeqNum: seqnum}
+}
+
+// Any messages still waiting to be acknowledged?  A trailing close
+// marker doesn't count
+func (con *lspConn) unacked() bool {
+	return con.pendingMsg != nil ||
+		(!con.sendBuf.Empty() && con.sendBuf.Front().Type == MsgDATA)
+}
+
+// Pending message has been acknowledged
+func (con *lspConn) acked() {
+	notifySent(con.pendingMsg, nil)
+	releaseSent(con.pendingMsg)
+	con.pendingMsg = nil
+	con.checkFlushed()
+}
+
+// Complete flushes once nothing left to acknowledge
+func (con *lspConn) checkFlushed() {
+	if !con.unacked() {
+		for !con.flushWaiters.Empty() {
+			notify(con.flushWaiters.Remove(), nil)
+		}
+	}
+}
+
+// Epochs have changed length from oldMs to newMs.  Rescale epoch
+// numbers relative to now, so that deadlines stay put in real time
+func (con *lspConn) rescale(now int64, oldMs, newMs int) {
+	con.lastHeardEpoch = rescaleEpoch(con.lastHeardEpoch, now, oldMs, newMs)
+	retime := func(m *LspMessage) {
+		if m != nil && (m.Type == MsgDATA || m.Type == MsgBUNDLE) && m.expires != 0 {
+			m.expires = rescaleEpoch(m.expires, now, oldMs, newMs)
+		}
+	}
+	retime(con.pendingMsg)
+	for m := range con.sendBuf.All() {
+		retime(m)
+	}
+	if con.nextExpiry != 0 {
+		con.nextExpiry = rescaleEpoch(con.nextExpiry, now, oldMs, newMs)
+	}
+	if con.caps.PathProbe {
+		con.probeAt = rescaleEpoch(con.probeAt, now, oldMs, newMs)
+	}
+}
+
+// Epoch at, relative to now, in epochs of different length.  Future
+// epochs round up, so that deadlines never come early
+func rescaleEpoch(at, now int64, oldMs, newMs int) int64 {
+	d := (at - now) * int64(oldMs)
+	if d > 0 {
+		return now + (d + int64(newMs) - 1) / int64(newMs)
+	}
+	return now + d / int64(newMs)
+}
+
+// Copy of params, with defaults filled in where left at 0
+func withDefaults(params *LspParams) *LspParams {
+	var p LspParams
+	if params != nil {
+		p = *params
+	}
+	if p.EpochLimit <= 0 {
+		p.EpochLimit = 5
+	}
+	if p.EpochMilliseconds <= 0 {
+		p.EpochMilliseconds = 2000
+	}
+	return &p
+}
+
+// Parameters that must be valid for running client or server, once
+// defaults are filled in
+func checkParams(params *LspParams) error {
+	return checkFEC(params.FECStripes)
+}
+
+// Queue message written by application.  Turns its time to live into
+// an expiry epoch.  Returns true if it expires sooner than any other
+func (con *lspConn) queue(m *LspMessage, now int64) bool {
+	con.sendBuf.Insert(m)
+	if m.expires == 0 {
+		return false
+	}
+	m.expires = m.expires * con.epochTicks + now
+	if con.nextExpiry == 0 || m.expires < con.nextExpiry {
+		con.nextExpiry = m.expires
+		return true
+	}
+	return false
+}
+
+// Drop messages that have expired by epoch now, and work out when the
+// next one will.  Unsent messages just vanish, since they have no
+// sequence number yet.  A pending message has already used its sequence
+// number, so it gets replaced by a skip message, which the other end
+// acknowledges without passing anything to its application.  Peers that
+// don't negotiate know nothing of skips, so a message already sent to
+// one stays until acknowledged.
+// Returns how many writes were dropped, and whether pending message was
+// replaced and should be sent
+func (con *lspConn) expire(now int64) (int, bool) {
+	next := int64(0)
+	dropped := 0
+	later := func(e int64) {
+		if e != 0 && (next == 0 || e < next) {
+			next = e
+		}
+	}
+	con.sendBuf.RemoveIf(func(m *LspMessage) bool {
+		if m.Type == MsgDATA && m.expires != 0 && m.expires <= now {
+			dropped++
+			notifySent(m, lsplog.Expired(con.connId))
+			releaseSent(m)
+			return true
+		}
+		later(m.expires)
+		return false
+	})
+	skipped := false
+	pm := con.pendingMsg
+	if pm != nil && con.caps.Version > legacyVersion {
+		if (pm.Type == MsgDATA || pm.Type == MsgBUNDLE) &&
+			pm.expires != 0 && pm.expires <= now {
+			dropped += max(len(pm.parts), 1)
+			notifySent(pm, lsplog.Expired(con.connId))
+			con.pendingMsg = GenMessage(MsgSKIP, pm.ConnId, pm.SeqNum, nil)
+			releaseSent(pm)
+			skipped = true
+		} else {
+			later(pm.expires)
+		}
+	}
+	con.nextExpiry = next
+	con.expired += dropped
+	con.checkFlushed()
+	return dropped, skipped
+}
+
+// Connection has ended.  Report error for every write still waiting
+// to be acknowledged, and for every flush
+func (con *lspConn) failUnacked(err error) {
+	if con.pendingMsg != nil {
+		notifySent(con.pendingMsg, err)
+	}
+	for m := range con.sendBuf.All() {
+		notifySent(m, err)
+	}
+	for !con.flushWaiters.Empty() {
+		notify(con.flushWaiters.Remove(), err)
+	}
+}
+
+// Handle flush request from application
+func (con *lspConn) flush(done chan error) {
+	if con.unacked() {
+		con.flushWaiters.Insert(done)
+	} else {
+		notify(done, nil)
+	}
+}
+
+// Send result to application without blocking
+func notify(done chan error, err error) {
+	select {
+	case done <- err:
+	default:
+	}
+}
+
+// Room held on each Done channel for outcomes of writes not yet
+// reported.  Shared by every client and server, since application may
+// pass one channel to several
+var doneRoom = struct {
+	sync.Mutex
+	held map[chan error] int
+}{held: make(map[chan error] int)}
+
+// Hold room on done for outcome of one write, so that reporting it
+// never finds the channel full
+func holdRoom(done chan error) error {
+	doneRoom.Lock()
+	defer doneRoom.Unlock()
+	n := doneRoom.held[done]
+	if len(done) + n >= cap(done) {
+		return lsplog.NoRoom(cap(done))
+	}
+	doneRoom.held[done] = n + 1
+	return nil
+}
+
+// Give up room held on done.  Call after sending on it, so that room
+// is never counted as free while still needed
+func freeRoom(done chan error) {
+	doneRoom.Lock()
+	defer doneRoom.Unlock()
+	if n := doneRoom.held[done] - 1; n > 0 {
+		doneRoom.held[done] = n
+	} else {
+		delete(doneRoom.held, done)
+	}
+}
+
+// Report outcome of write, if application asked for it.  For bundle,
+// report outcome of each write in it
+func notifySent(m *LspMessage, err error) {
+	for _, p := range m.parts {
+		notifySent(p, err)
+	}
+	if m.notify != nil {
+		notify(m.notify, err)
+		freeRoom(m.notify)
+		m.notify = nil
+	}
+}
+
+// Data message generated by application write.  Has its own copy of payload
+func newSentMessage(id uint16, payload []byte, done chan error, ttl int) *LspMessage {
+	m := newMessage()
+	m.Type = MsgDATA
+	m.ConnId = id
+	m.Payload = copyPayload(payload)
+	m.notify = done
+	// Converted to epoch once queued
+	m.expires = int64(ttl)
+	return m
+}
+
+// Time to live for write, in epochs.  0 if message never expires
+func writeTTL(opts WriteOptions, params *LspParams) int {
+	if opts.TTL < 0 {
+		return 0
+	}
+	if opts.TTL == 0 {
+		return params.MessageTTL
+	}
+	return opts.TTL
+}
+
+// Flush request from application
+func newFlushMessage(id uint16, done chan error) *LspMessage {
+	m := newMessage()
+	m.Type = msgFLUSH
+	m.ConnId = id
+	m.notify = done
+	return m
+}
+
+// Recycle data message or bundle once acknowledged
+func releaseSent(m *LspMessage) {
+	if m.Type == MsgDATA || m.Type == MsgBUNDLE {
+		for _, p := range m.parts {
+			releaseSent(p)
+		}
+		if m.notify != nil {
+			// Write refused, so outcome never reported
+			freeRoom(m.notify)
+		}
+		ReleasePayload(m.Payload)
+		releaseMessage(m)
+	}
+}
+
 // Return the Connection ID for a client
 func (cli *LspClient) iConnId() uint16 {
 	return cli.lspConn.connId
 }
 
-// Goroutine for triggering epoch events
-func epochTrigger(ms int, ec chan int, stop *bool) {
-	d := time.Duration(ms) * time.Millisecond
-	for !*stop {
-		time.Sleep(d)
-		ec <- 1
+func (cli *LspClient) iCapabilities() Capabilities {
+	var caps Capabilities
+	if !cli.query(func() { caps = cli.lspConn.caps }) {
+		// Loop has finished.  Nothing changes caps any more
+		caps = cli.lspConn.caps
 	}
+	return caps
+}
+
+func (cli *LspClient) iPathMTU() int {
+	var mtu int
+	if !cli.query(func() { mtu = cli.lspConn.packetLimit() }) {
+		mtu = cli.lspConn.packetLimit()
+	}
+	return mtu
+}
+
+func (cli *LspClient) iState() ClientState {
+	var state ClientState
+	if !cli.query(func() { state = cli.status.State }) {
+		// Loop has finished.  State won't change again
+		state = cli.status.State
+	}
+	return state
+}
+
+func (cli *LspClient) iSubscribe() (<-chan ClientStatus, func()) {
+	ch := make(chan ClientStatus, 1)
+	if !cli.query(func() {
+		ch <- cli.status
+		cli.subs = append(cli.subs, ch)
+	}) {
+		ch <- cli.status
+		close(ch)
+		return ch, func() {}
+	}
+	cancel := func() {
+		cli.query(func() {
+			// Gone already if cancelled before
+			if i := slices.Index(cli.subs, ch); i >= 0 {
+				cli.subs = slices.Delete(cli.subs, i, i + 1)
+				close(ch)
+			}
+		})
+	}
+	return ch, cancel
+}
+
+// Record change of state, and tell subscribers.  Runs in loop
+func (cli *LspClient) setState(state ClientState, err error) {
+	cli.Vlogf(4, "State now %v\n", state)
+	cli.status.State = state
+	cli.status.Err = err
+	cli.publish()
+}
+
+// Send current status to every subscriber, replacing any status
+// still unread.  Runs in loop, which is the only sender
+func (cli *LspClient) publish() {
+	for _, ch := range cli.subs {
+		for sent := false; !sent; {
+			select {
+			case ch <- cli.status:
+				sent = true
+			default:
+				// Full.  Discard stale status, unless reader just took it
+				select {
+				case <- ch:
+				default:
+				}
+			}
+		}
+	}
+}
+
+var clientStateName = map [ClientState] string {
+	ClientConnecting: "connecting",
+	ClientConnected: "connected",
+	ClientClosing: "closing",
+	ClientLost: "lost",
+	ClientClosed: "closed",
+}
+
+func (cs ClientState) String() string {
+	return clientStateName[cs]
+}
+
+// Client state appears by name in JSON
+func (cs ClientState) MarshalText() ([]byte, error) {
+	return []byte(cs.String()), nil
+}
+
+func (cli *LspClient) iLocalAddr() net.Addr {
+	return cli.transport.LocalAddr()
+}
+
+// Start goroutine for triggering epoch events, counted by wg.  Ticker is
+// running by the time call returns, so that a ManualClock advanced from
+// then on drives it
+func startEpochTrigger(wg *sync.WaitGroup, clock Clock, ms int, ec chan int, reset chan int, done chan bool) {
+	tick, stop, finished := newSyncTicker(clock, time.Duration(ms) * time.Millisecond)
+	spawn(wg, func() {
+		epochTrigger(clock, tick, stop, finished, ec, reset, done)
+	})
+}
+
+// Goroutine for triggering epoch events.  Each is followed by a 0,
+// which the loop takes once it has finished with the epoch, so that
+// the clock can know.  Changes to new epoch length sent on reset.
+// Stops once done is closed
+func epochTrigger(clock Clock, tick <-chan time.Time, stop, finished func(),
+	ec chan int, reset chan int, done chan bool) {
+	var ms int
+	defer func() { stop() }()
+	for {
+		select {
+		case <- tick:
+			select {
+			case ec <- 1:
+				select {
+				case ec <- 0:
+					finished()
+				case <- done:
+					return
+				}
+			case ms = <- reset:
+			case <- done:
+				return
+			}
+		case ms = <- reset:
+		case <- done:
+			return
+		}
+		if ms > 0 {
+			stop()
+			tick, stop, finished = newSyncTicker(clock, time.Duration(ms) * time.Millisecond)
+			ms = 0
+		}
+	}
+}
+
+// Run f in a goroutine counted by wg
+func spawn(wg *sync.WaitGroup, f func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -63,61 +517,144 @@ func epochTrigger(ms int, ec chan int, stop *bool) {
 
 
 type iLspClient struct {
-	params *LspParams
+	params atomic.Pointer[LspParams] // Replaced by SetParams
 	lspConn *lspConn
-	udpConn *lspnet.UDPConn
-	readBuf *Buf  // Results that are ready to be read
+	transport PacketTransport
+	readBuf *Queue[*LspMessage] // Results that are ready to be read
 	appReadChan LspMessageChan   // Supply results for Creation & Read functions
 	appWriteChan LspMessageChan  // Requests to write
-	netInChan LspMessageChan // Inputs from network
+	netInChan networkChan // Inputs from network
 	epochChan chan int  // For triggering epochs
+	epochReset chan int // For changing epoch length
+	dial dialAttempt // How to time connection request
+	connectChan chan int // Connection request timer events
+	netErrChan chan error // Socket errors, which tell why connecting failed
+	connected chan bool // Closed once connection established
+	coalesceMs int // Coalescing delay
+	coalesceArm chan int // Start coalescing timer
+	coalesceFire chan int // Coalescing timer has run out
+	coalesceArmed bool
+	queryChan chan func() // Functions to run in loop on behalf of application
 	currentEpoch int64
 	stopAppFlag bool
+	status ClientStatus // Current state, as reported to subscribers
+	subs []chan ClientStatus // Subscribers' channels, each holding latest status
+	netDone chan bool // Closed when network operations stop
+	loopDone chan bool // Closed when event loop has finished
+	goroutines sync.WaitGroup // All internal goroutines
 	// For communicating results back to function calls
-	closeReplyChan chan error 
 	writeReplyChan chan error
 }
 
-func iNewLspClient(hostport string, params *LspParams) (*LspClient, error) {
-	cli := new(LspClient)
-	if params == nil {
-		// Insert default parameters
-		params = &LspParams{5,2000}
+// Timing of connection request to one address.  Zero durations leave
+// it to epochs
+type dialAttempt struct {
+	name string // Server, as named in errors
+	timeout time.Duration
+	retry, maxRetry time.Duration
+}
+
+// Connection request timer events
+const (
+	connectRetry = iota
+	connectTimeout
+)
+
+func iDialLspClient(hostport string, params *LspParams, opts DialOptions) (*LspClient, error) {
+	params = withDefaults(params)
+	clock := paramsClock(params)
+	deadline := clock.Now().Add(opts.Timeout)
+	addrs := append([]string{hostport}, opts.Alternates...)
+	var err error
+	for i, addr := range addrs {
+		d := dialAttempt{name: addr, retry: opts.RetryInterval, maxRetry: opts.MaxRetryInterval}
+		if opts.Timeout > 0 {
+			left := deadline.Sub(clock.Now())
+			if left <= 0 && err != nil {
+				break
+			}
+			d.timeout = max(left / time.Duration(len(addrs) - i), time.Millisecond)
+		}
+		var cli *LspClient
+		if cli, err = dialAddr(params, d); err == nil {
+			return cli, nil
+		}
+		lsplog.Vlogf(1, "C: Can't connect to %v: %v\n", addr, err)
 	}
-	cli.params = params
-	addr, err := lspnet.ResolveUDPAddr("udp", hostport)
-	if lsplog.CheckReport(1, err) {
-		return nil, err
+	return nil, err
+}
+
+// Try connecting to one address
+func dialAddr(params *LspParams, d dialAttempt) (*LspClient, error) {
+	t, err := DialUDPTransport("udp", d.name)
+	if err != nil {
+		return nil, lsplog.Unreachable(d.name, err)
 	}
-	cli.lspConn = newConn(addr, 0, 0)
+	return newClient(t, params, d)
+}
+
+func iNewLspClientTransport(t PacketTransport, params *LspParams) (*LspClient, error) {
+	return newClient(t, params, dialAttempt{name: "server"})
+}
+
+func newClient(t PacketTransport, params *LspParams, d dialAttempt) (*LspClient, error) {
+	cli := new(LspClient)
+	params = withDefaults(params)
+	cli.params.Store(params)
+	cli.transport = t
+	cli.dial = d
+	// Transport knows where server is
+	cli.lspConn = newConn(netip.AddrPort{}, 0, 0)
 	// Client's first received message will be data message.
 	cli.lspConn.nextRecvSeqNum = NextSeqNum(0)
-	cli.udpConn, err = lspnet.DialUDP("udp", nil, addr)
-	if lsplog.CheckReport(1, err) {
-		return nil, err
-	}
+	cli.lspConn.epochLimit = params.EpochLimit
+	cli.lspConn.compressMin = compressMin(params)
+	cli.lspConn.noDelay = params.NoDelay
+	cli.coalesceMs = params.CoalesceMilliseconds
+	cli.status = ClientStatus{State: ClientConnecting, EpochLimit: params.EpochLimit}
 	// Need enough room to recycle close messages at end
 	cli.appReadChan = make(LspMessageChan, 2)
-	cli.readBuf = NewBuf()
-	cli.appWriteChan = make(LspMessageChan, 1)
-	cli.netInChan = make(LspMessageChan, 1)
+	cli.readBuf = NewQueue[*LspMessage](0)
+	// Unbuffered, so that nothing is left in it once loop has finished
+	cli.appWriteChan = make(LspMessageChan)
+	cli.netInChan = make(networkChan, 1)
 	cli.epochChan = make(chan int)
-	cli.closeReplyChan = make(chan error, 2)
+	cli.epochReset = make(chan int, 1)
+	cli.queryChan = make(chan func())
+	cli.connectChan = make(chan int)
+	cli.netErrChan = make(chan error, 1)
+	cli.connected = make(chan bool)
+	cli.coalesceArm = make(chan int, 1)
+	cli.coalesceFire = make(chan int)
+	cli.netDone = make(chan bool)
+	cli.loopDone = make(chan bool)
 	cli.writeReplyChan = make(chan error, 2)
 
-	go cli.clientLoop()
-	go cli.udpReader()
-	go epochTrigger(cli.params.EpochMilliseconds, cli.epochChan, &cli.lspConn.stopNetworkFlag)
-	// Send connection request to server
-	nm := GenConnectMessage()
-	cli.udpWrite(nm)
+	// Send connection request to server, with what we support
+	nm := genOfferMessage(localCapabilities(params))
 	cli.lspConn.pendingMsg = nm
 	cli.lspConn.nextSendSeqNum = NextSeqNum(0)
+	spawn(&cli.goroutines, cli.clientLoop)
+	spawn(&cli.goroutines, cli.udpReader)
+	startEpochTrigger(&cli.goroutines, paramsClock(params), params.EpochMilliseconds,
+		cli.epochChan, cli.epochReset, cli.netDone)
+	spawn(&cli.goroutines, func() {
+		coalesceTimer(paramsClock(params), cli.coalesceArm, cli.coalesceFire, cli.netDone)
+	})
+	if d.retry > 0 || d.timeout > 0 {
+		spawn(&cli.goroutines, func() {
+			connectTimer(paramsClock(params), d, cli.connectChan,
+				cli.connected, cli.netDone)
+		})
+	}
+	cli.udpWrite(nm)
 	cm := <- cli.appReadChan
 	if cm.Type == MsgCONNECT {
 		return cli, nil
 	}
-	return nil, lsplog.MakeErr("Connection failed")
+	// Network has stopped.  Shut down rest of client
+	cli.iClose()
+	return nil, cli.closedErr()
 }
 
 // Main client loop
@@ -125,80 +662,187 @@ func (cli *LspClient) clientLoop() {
 	for !(cli.stopAppFlag && cli.lspConn.stopNetworkFlag) {
 		if cli.readBuf.Empty() {
 			select {
-			case netm := <-cli.netInChan:
-				cli.handleNetMessage(netm)
+			case netd := <-cli.netInChan:
+				cli.handleNetMessage(netd)
+				releaseNetworkData(netd)
 			case appm := <-cli.appWriteChan:
 				cli.handleAppWrite(appm)
-			case <- cli.epochChan:
-				cli.handleEpoch()
+			case n := <- cli.epochChan:
+				if n > 0 {
+					cli.handleEpoch()
+				}
+			case ev := <- cli.connectChan:
+				cli.handleConnectTimer(ev)
+			case err := <- cli.netErrChan:
+				cli.handleNetError(err)
+			case <- cli.coalesceFire:
+				cli.coalesceArmed = false
+				cli.flushHeld()
+			case f := <- cli.queryChan:
+				f()
 			}
 		} else {
-			v := cli.readBuf.Front()
-			rm := v.(*LspMessage)
+			rm := cli.readBuf.Front()
 			if rm.Type == MsgINVALID {
 				// Have completed all reads.  Stop applications
 				cli.stopAppFlag = true
 			}
 			select {
-			case netm := <-cli.netInChan:
-				cli.handleNetMessage(netm)
+			case netd := <-cli.netInChan:
+				cli.handleNetMessage(netd)
+				releaseNetworkData(netd)
 			case appm := <-cli.appWriteChan:
 				cli.handleAppWrite(appm)
-			case <- cli.epochChan:
-				cli.handleEpoch()
+			case n := <- cli.epochChan:
+				if n > 0 {
+					cli.handleEpoch()
+				}
+			case ev := <- cli.connectChan:
+				cli.handleConnectTimer(ev)
+			case err := <- cli.netErrChan:
+				cli.handleNetError(err)
+			case <- cli.coalesceFire:
+				cli.coalesceArmed = false
+				cli.flushHeld()
+			case f := <- cli.queryChan:
+				f()
 			case cli.appReadChan <- rm:
 				cli.readBuf.Remove()
 			}
 		}
 		cli.checkToSend()
+		if cli.lspConn.held && cli.coalesceMs <= 0 {
+			cli.flushHeld()
+		}
+	}
+	if cli.status.State != ClientLost {
+		cli.setState(ClientClosed, nil)
 	}
+	for _, ch := range cli.subs {
+		close(ch)
+	}
+	cli.subs = nil
 	// Make sure any subsequent operations fail
-	cli.closeReplyChan <- nil
-	cli.writeReplyChan <- lsplog.ConnectionClosed()
-	cm := GenInvalidMessage(0, 0)
-	cli.appReadChan <- cm
+	close(cli.loopDone)
 }
 
 // Receive message from network
-func (cli *LspClient) handleNetMessage(netm *LspMessage) {
+func (cli *LspClient) handleNetMessage(netd *networkData) {
+	netm := netd.msg
 	lspConn := cli.lspConn
+	if lspConn.connId != 0 && netm.ConnId != lspConn.connId {
+		cli.Vlogf(3, "Dropping %s.  Not for this connection\n", netm)
+		return
+	}
 	lspConn.lastHeardEpoch = cli.currentEpoch
+	if cli.status.SilentEpochs != 0 {
+		cli.status.SilentEpochs = 0
+		cli.publish()
+	}
 	switch netm.Type {
-	case MsgDATA:
+	case MsgDATA, MsgSKIP, MsgBUNDLE, MsgSTRIPE:
 		if lspConn.connId == 0 {
 			cli.Vlogf(6, "Data received when connection not yet established\n")
 			return
 		}
 		n := lspConn.nextRecvSeqNum
 		if netm.SeqNum == n {
-			cli.readBuf.Insert(netm)
+			if netm.Type == MsgSTRIPE {
+				// Stripe now belongs to connection.  Carry on with
+				// message once rebuilt
+				netd.kept = true
+				if netm = lspConn.addStripe(netm); netm == nil {
+					return
+				}
+				netd.msg, netd.kept = netm, false
+			}
+			if netm.Type == MsgDATA && !lspConn.decode(netm) {
+				cli.Vlogf(1, "Dropping data message #%v.  Can't decode payload\n", n)
+				return
+			}
+			// Skip only uses up sequence number
+			switch netm.Type {
+			case MsgDATA:
+				cli.readBuf.Insert(netm)
+				netd.kept = true
+			case MsgBUNDLE:
+				if !lspConn.unbundle(netm, cli.readBuf) {
+					cli.Vlogf(1, "Dropping bundle #%v.  Can't split it\n", n)
+					return
+				}
+			}
 			lspConn.nextRecvSeqNum = NextSeqNum(n)
 			// Generate acknowledgement
-			lspConn.lastAck = GenAckMessage(lspConn.connId, n)
-			cli.udpWrite(lspConn.lastAck)
-			cli.Vlogf(4, "Received & acknowledged %s\n", netm)
+			lspConn.setAck(n)
+			cli.sendAck()
+			if lsplog.Enabled(4) {
+				cli.Vlogf(4, "Received & acknowledged %s\n", netm)
+			}
 		} else {
 			cli.Vlogf(6, "Ignoring data message #%v.  Expecting %v\n",
 				netm.SeqNum, n)
 			return
 		}
+	case MsgINVALID:
+		pm := lspConn.pendingMsg
+		if lspConn.connId == 0 && pm != nil && pm.Type == MsgCONNECT {
+			cli.Vlogf(1, "Connection refused by server: %s\n", netm.Payload)
+			cli.lose(lsplog.ConnectionRefused(string(netm.Payload)))
+		}
+	case MsgPROBE:
+		if lspConn.connId == 0 {
+			return
+		}
+		if netm.Payload != nil {
+			a := probeAnswer(netm)
+			cli.udpWrite(&a)
+		} else {
+			cli.sendProbe(lspConn.probeAnswered(netm, cli.currentEpoch))
+		}
 	case MsgACK:
 		if lspConn.pendingMsg == nil {
-			cli.Vlogf(6, "Ignoring ack message #%v.  No message pending\n",
-				netm.SeqNum)
+			if lsplog.Enabled(6) {
+				cli.Vlogf(6, "Ignoring ack message #%v.  No message pending\n",
+					netm.SeqNum)
+			}
 			return
 		}
 		n := lspConn.pendingMsg.SeqNum
 		if netm.SeqNum == n {
-			cli.Vlogf(5, "Acknowledgement %v received\n", n)
+			if lsplog.Enabled(5) {
+				cli.Vlogf(5, "Acknowledgement %v received\n", n)
+			}
 			if n == 0 {
 				if lspConn.pendingMsg.Type == MsgCONNECT {
+					params := cli.params.Load()
+					caps, err := acceptAgreed(netm.Payload, localCapabilities(params))
+					if err != nil {
+						cli.Vlogf(1, "%v\n", err)
+						cli.lose(err)
+						return
+					}
+					lspConn.caps = caps
+					lspConn.codec = agreedCodec(caps)
+					lspConn.coalesce = caps.Coalesce
+					if caps.FEC {
+						lspConn.fec = fecStripes(params)
+					}
+					lspConn.epochLimit = caps.EpochLimit
+					if caps.EpochMilliseconds != params.EpochMilliseconds {
+						cli.Vlogf(3, "Using epochs of %vms\n", caps.EpochMilliseconds)
+						cli.epochReset <- caps.EpochMilliseconds
+					}
 					lspConn.connId = netm.ConnId
+					close(cli.connected)
 					cli.Vlogf(3, "Connected to server with ID %v\n",
 						netm.ConnId)
+					cli.status.EpochLimit = caps.EpochLimit
+					cli.setState(ClientConnected, nil)
 					// Set up acknowledgement message with sequence number 0
 					// for epoch events
-					lspConn.lastAck = GenAckMessage(lspConn.connId, 0)
+					lspConn.setAck(0)
+					lspConn.startProbing(cli.currentEpoch)
+					cli.checkProbe()
 					// Let NewLspClient know that connection is established
 					cli.appReadChan <- lspConn.pendingMsg
 				} else {
@@ -206,7 +850,7 @@ func (cli *LspClient) handleNetMessage(netm *LspMessage) {
 						typeName[lspConn.pendingMsg.Type])
 				}
 			}
-			lspConn.pendingMsg = nil
+			lspConn.acked()
 		} else {
 			cli.Vlogf(6, "Ignoring ack message #%v.  Expecting %v\n",
 				netm.SeqNum, n)
@@ -219,10 +863,46 @@ func (cli *LspClient) handleNetMessage(netm *LspMessage) {
 
 // Process write or close
 func (cli *LspClient) handleAppWrite(appm *LspMessage) {
+	con := cli.lspConn
+	if appm.Type == msgFLUSH {
+		if con.closeErr != nil {
+			notify(appm.notify, con.closeErr)
+		} else {
+			con.flush(appm.notify)
+		}
+		releaseMessage(appm)
+		return
+	}
+	if appm.Type == MsgDATA && con.closeErr != nil {
+		releaseSent(appm)
+		cli.writeReplyChan <- con.closeErr
+		return
+	}
+	if appm.Type == MsgDATA && len(appm.Payload) > con.caps.MaxPayload {
+		err := lsplog.PayloadTooLarge(len(appm.Payload), con.caps.MaxPayload)
+		releaseSent(appm)
+		cli.writeReplyChan <- err
+		return
+	}
 	// Queue data or close message to send over network
-	cli.lspConn.sendBuf.Insert(appm)
+	idle := con.pendingMsg == nil && con.sendBuf.Empty()
+	if appm.Type == MsgDATA {
+		appm.Payload = con.encode(appm.Payload)
+	}
+	con.queue(appm, cli.currentEpoch)
+	if idle && appm.Type == MsgDATA && con.coalescing() && cli.coalesceMs > 0 {
+		// Nothing ahead of it.  Wait for company
+		con.holdData = true
+		cli.hold()
+	}
 	if appm.Type == MsgINVALID {
-		cli.stopApp(true)
+		if con.closeErr == nil {
+			con.closeErr = lsplog.ConnectionClosed(con.connId)
+		}
+		if cli.status.State == ClientConnected {
+			cli.setState(ClientClosing, nil)
+		}
+		cli.stopApp(true, con.closeErr)
 	} else {
 		cli.writeReplyChan <- nil
 	}
@@ -231,29 +911,160 @@ func (cli *LspClient) handleAppWrite(appm *LspMessage) {
 // Process epoch event
 func (cli *LspClient) handleEpoch() {
 	cli.currentEpoch ++
-	if int(cli.currentEpoch - cli.lspConn.lastHeardEpoch) > cli.params.EpochLimit {
-		cli.Vlogf(3, "Epoch limit of %v exceeded.\n", cli.params.EpochLimit)
-		// Shut down network & apps
-		cli.stopNetwork()
-		// Not ready to stop reads
-		cli.stopApp(false)
-		// See if have failed to get connection
-		if cli.lspConn.connId == 0 {
-			cli.Vlogf(5, "Failed to establish connection\n")
-			// Send signal to NewLspClient
-			cli.appReadChan <- GenInvalidMessage(0, 0)
+	// Whole epochs that have passed without word from server
+	silent := int(cli.currentEpoch - cli.lspConn.lastHeardEpoch) - 1
+	// Connect timer, if set, takes over from epochs until connected
+	connecting := cli.lspConn.connId == 0
+	if silent >= cli.lspConn.epochLimit && !(connecting && cli.dial.timeout > 0) {
+		cli.Vlogf(3, "Epoch limit of %v exceeded.\n", cli.lspConn.epochLimit)
+		if connecting {
+			cli.lose(lsplog.Timeout("Connection to " + cli.dial.name))
+		} else {
+			cli.lose(lsplog.ConnectionLost(cli.lspConn.connId, lsplog.ErrTimeout))
 		}
 	} else {
+		if silent != cli.status.SilentEpochs {
+			cli.status.SilentEpochs = silent
+			cli.publish()
+		}
+		con := cli.lspConn
+		if con.nextExpiry != 0 && cli.currentEpoch >= con.nextExpiry {
+			// Any skip message gets sent below, along with other resends
+			if n, _ := con.expire(cli.currentEpoch); n > 0 {
+				cli.Vlogf(2, "Dropped %v expired writes (%v in all)\n", n, con.expired)
+			}
+		}
 		pm := cli.lspConn.pendingMsg
-		if pm != nil {
+		if pm != nil && !(connecting && cli.dial.retry > 0) {
 			cli.Vlogf(6, "Resending message %s\n", pm)
-			cli.udpWrite(pm)
+			if !connecting {
+				con.resent++
+			}
+			cli.sendData(pm)
 		}
 		am := cli.lspConn.lastAck
 		if am != nil {
 			cli.Vlogf(6, "Resending ack #%v\n", am.SeqNum)
 			cli.udpWrite(am)
 		}
+		cli.checkProbe()
+	}
+}
+
+// Send path MTU probe if one is due
+func (cli *LspClient) checkProbe() {
+	con := cli.lspConn
+	if con.caps.PathProbe && con.connId != 0 && cli.currentEpoch >= con.probeAt {
+		cli.sendProbe(con.probeDue(cli.currentEpoch))
+	}
+}
+
+// Send probe of given size, unless 0
+func (cli *LspClient) sendProbe(size int) {
+	if size == 0 {
+		return
+	}
+	bp := packetPool.Get().(*[]byte)
+	b := cli.lspConn.appendProbe((*bp)[:0], size)
+	if lsplog.Enabled(6) {
+		cli.Vlogf(6, "Probing path with %v bytes\n", len(b))
+	}
+	cli.writePacket(b)
+	*bp = b[:0]
+	packetPool.Put(bp)
+}
+
+// Process connection request timer event
+func (cli *LspClient) handleConnectTimer(ev int) {
+	con := cli.lspConn
+	if con.connId != 0 || con.stopNetworkFlag {
+		return
+	}
+	if ev == connectTimeout {
+		cli.Vlogf(3, "No answer from %v\n", cli.dial.name)
+		cli.lose(lsplog.Timeout("Connection to " + cli.dial.name))
+	} else if con.pendingMsg != nil {
+		cli.Vlogf(6, "Resending connection request\n")
+		cli.udpWrite(con.pendingMsg)
+	}
+}
+
+// Process socket error.  While connecting, one that says the server
+// refused or can't be reached ends the attempt.  Once connected, the
+// epoch limit decides
+func (cli *LspClient) handleNetError(err error) {
+	con := cli.lspConn
+	if con.connId != 0 || con.stopNetworkFlag {
+		return
+	}
+	if derr := dialError(cli.dial.name, err); derr != nil {
+		cli.Vlogf(1, "%v\n", derr)
+		cli.lose(derr)
+	}
+}
+
+// Goroutine that times connection request.  Sends connectRetry on ch
+// at intervals that start at d.retry and double up to d.maxRetry, and
+// connectTimeout once d.timeout has passed.  Zero durations send
+// nothing.  Stops once connected or done is closed
+func connectTimer(clock Clock, d dialAttempt, ch chan int, connected, done chan bool) {
+	var retryTick, timeoutTick <-chan time.Time
+	stopRetry, stopTimeout := func() {}, func() {}
+	if d.retry > 0 {
+		retryTick, stopRetry = clock.NewTicker(d.retry)
+	}
+	if d.timeout > 0 {
+		timeoutTick, stopTimeout = clock.NewTicker(d.timeout)
+	}
+	defer func() {
+		stopRetry()
+		stopTimeout()
+	}()
+	interval := d.retry
+	for {
+		ev := connectRetry
+		select {
+		case <- retryTick:
+			interval *= 2
+			if d.maxRetry > 0 {
+				interval = min(interval, d.maxRetry)
+			}
+			stopRetry()
+			retryTick, stopRetry = clock.NewTicker(interval)
+		case <- timeoutTick:
+			ev = connectTimeout
+		case <- connected:
+			return
+		case <- done:
+			return
+		}
+		select {
+		case ch <- ev:
+		case <- connected:
+			return
+		case <- done:
+			return
+		}
+		if ev == connectTimeout {
+			return
+		}
+	}
+}
+
+// Connection has ended without application closing it
+func (cli *LspClient) lose(err error) {
+	cli.lspConn.closeErr = err
+	cli.setState(ClientLost, err)
+	cli.lspConn.failUnacked(err)
+	// Shut down network & apps
+	cli.stopNetwork()
+	// Not ready to stop reads
+	cli.stopApp(false, err)
+	// See if have failed to get connection
+	if cli.lspConn.connId == 0 {
+		cli.Vlogf(5, "Failed to establish connection\n")
+		// Send signal to NewLspClient
+		cli.appReadChan <- GenInvalidMessage(0, 0)
 	}
 }
 
@@ -261,8 +1072,13 @@ func (cli *LspClient) handleEpoch() {
 func (cli *LspClient) checkToSend() {
 	con := cli.lspConn
 	if !con.sendBuf.Empty() && con.connId > 0 && con.pendingMsg == nil {
-		d := con.sendBuf.Remove()
-		sm := d.(*LspMessage)
+		if con.holdData {
+			if !con.bundleFull() {
+				return
+			}
+			con.holdData = false
+		}
+		sm := con.nextToSend()
 		n := con.nextSendSeqNum
 		sm.ConnId = con.connId
 		sm.SeqNum = n
@@ -273,61 +1089,207 @@ func (cli *LspClient) checkToSend() {
 			cli.stopNetwork()
 		} else {
 			con.pendingMsg = sm
-			cli.Vlogf(4, "Sending message %s\n", sm)
-			cli.udpWrite(sm)
+			if lsplog.Enabled(4) {
+				cli.Vlogf(4, "Sending message %s\n", sm)
+			}
+			cli.sendData(sm)
 		}
 	}
 }
 
-// Goroutine that reads messages from UDP connection and writes to message channel
+// Acknowledge data.  When coalescing, hold acknowledgement back so
+// that it can go along with data
+func (cli *LspClient) sendAck() {
+	con := cli.lspConn
+	if con.coalescing() {
+		con.ackDue = true
+		cli.hold()
+	} else {
+		cli.writeAck()
+	}
+}
+
+// Write acknowledgement.  With FEC, twice, since it can't be rebuilt
+func (cli *LspClient) writeAck() {
+	cli.udpWrite(cli.lspConn.lastAck)
+	if cli.lspConn.fec > 0 {
+		cli.udpWrite(cli.lspConn.lastAck)
+	}
+}
+
+// Note that connection has output held back, and start timer if needed
+func (cli *LspClient) hold() {
+	cli.lspConn.held = true
+	if cli.coalesceMs > 0 && !cli.coalesceArmed {
+		cli.coalesceArmed = true
+		cli.coalesceArm <- cli.coalesceMs
+	}
+}
+
+// Send whatever has been held back
+func (cli *LspClient) flushHeld() {
+	con := cli.lspConn
+	con.held = false
+	con.holdData = false
+	if con.stopNetworkFlag {
+		return
+	}
+	cli.checkToSend()
+	if con.ackDue {
+		con.ackDue = false
+		cli.writeAck()
+	}
+}
+
+// Write data message to transport, along with any acknowledgement
+// held back
+func (cli *LspClient) sendData(msg *LspMessage) {
+	con := cli.lspConn
+	if k := con.stripesFor(msg); k > 0 {
+		cli.sendStripes(msg, k)
+		return
+	}
+	if !con.ackDue {
+		cli.udpWrite(msg)
+		return
+	}
+	con.ackDue = false
+	bp := packetPool.Get().(*[]byte)
+	b, split := appendCoalesced((*bp)[:0], con.lastAck, msg, con.packetLimit())
+	cli.writeCoalesced(b, split)
+	*bp = b[:0]
+	packetPool.Put(bp)
+}
+
+// Write datagram packed by appendCoalesced, as two if it had to split
+func (cli *LspClient) writeCoalesced(b []byte, split int) {
+	if split == 0 {
+		cli.writePacket(b)
+	} else {
+		cli.writePacket(b[:split-1])
+		cli.writePacket(b[split:])
+	}
+}
+
+// Write message as k stripes, with parity if FEC is on.  Any
+// acknowledgement held back goes along with the first and the last
+func (cli *LspClient) sendStripes(msg *LspMessage, k int) {
+	con := cli.lspConn
+	scratch := getPayload(stripeRoom(msg, k))
+	bp := packetPool.Get().(*[]byte)
+	ack := con.ackDue
+	con.ackDue = false
+	last := k - 1
+	if con.fec > 0 {
+		last = k
+	}
+	for i := 0; i <= last; i++ {
+		s := stripeOf(scratch, msg, k, i)
+		b, split := (*bp)[:0], 0
+		if ack && (i == 0 || i == last) {
+			b, split = appendCoalesced(b, con.lastAck, &s, con.packetLimit())
+		} else {
+			b = s.appendPacket(b)
+		}
+		cli.writeCoalesced(b, split)
+		*bp = b[:0]
+	}
+	packetPool.Put(bp)
+	ReleasePayload(scratch)
+}
+
+// Goroutine that reads messages from transport and writes to message channel.
+// Runs until network stopped
 func (cli *LspClient) udpReader() {
-	udpConn := cli.udpConn
+	t := cli.transport
 	mc := cli.netInChan
-	var buffer [1500] byte
-	for !cli.lspConn.stopNetworkFlag {
-		n, _, err := udpConn.ReadFromUDP(buffer[0:])
-		if lsplog.CheckReport(1, err) {
-			cli.Vlogf(6, "Client continuing\n")
+	var buffer [maxPacketSize] byte
+	for {
+		n, addr, err := t.ReadFrom(buffer[0:])
+		if err != nil {
+			select {
+			case <- cli.netDone:
+				// Connection closed under us
+				return
+			default:
+			}
+			lsplog.CheckReport(1, err)
+			cli.reportNetError(err)
+			lsplog.Vlogf(6, "C: Client continuing\n")
 			continue
 		}
-		m, merr := extractMessage(buffer[0:n])
-		if lsplog.CheckReport(1, merr) {
-			cli.Vlogf(6, "Client continuing\n")
-			continue
+		// Datagram may hold several coalesced messages
+		for p := buffer[0:n]; len(p) > 0; {
+			m, rest, merr := extractMessage(p)
+			p = rest
+			if lsplog.CheckReport(1, merr) {
+				lsplog.Vlogf(6, "C: Client continuing\n")
+				break
+			}
+			d := newNetworkData(m, addr)
+			select {
+			case mc <- d:
+			case <- cli.netDone:
+				releaseNetworkData(d)
+				return
+			}
 		}
-		mc <- m
 	}
 }
 
-// Write message to UDP connection.  Address already registered with connection
+// Write message to transport.  Address already registered with connection
 func (cli *LspClient) udpWrite(msg *LspMessage) {
-	b := msg.genPacket()
-	_, err := cli.udpConn.Write(b)
+	bp := packetPool.Get().(*[]byte)
+	b := msg.appendPacket((*bp)[:0])
+	cli.writePacket(b)
+	*bp = b[:0]
+	packetPool.Put(bp)
+}
+
+func (cli *LspClient) writePacket(b []byte) {
+	_, err := cli.transport.WriteTo(b, cli.lspConn.addr)
 	if lsplog.CheckReport(6, err) {
 		cli.Vlogf(6, "Write failed\n")
+		cli.reportNetError(err)
+	}
+}
+
+// Pass socket error to loop, unless one is already waiting
+func (cli *LspClient) reportNetError(err error) {
+	select {
+	case cli.netErrChan <- err:
+	default:
 	}
 }
 
 // Reporting from client
 func (cli *LspClient) Vlogf(level int, format string, v ...interface{}) {
+	if !lsplog.Enabled(level) {
+		return
+	}
 	nformat := fmt.Sprintf("C%v: %s", cli.lspConn.connId, format)
 	lsplog.Vlogf(level, nformat, v...)
 }
 
 // Shutting down network communications
 func (cli *LspClient) stopNetwork() {
+	if cli.lspConn.stopNetworkFlag {
+		return
+	}
 	cli.lspConn.stopNetworkFlag = true
-	err := cli.udpConn.Close()
+	close(cli.netDone)
+	err := cli.transport.Close()
 	if lsplog.CheckReport(4, err) {
 		lsplog.Vlogf(6, "Client Continuing\n")
 	}
 }
 
-// Shutting down app read/writes
-func (cli *LspClient) stopApp(setFlag bool) {
+// Shutting down app read/writes.  Reads fail with err
+func (cli *LspClient) stopApp(setFlag bool, err error) {
 	// Send close message to application
 	cli.Vlogf(6, "Disabling reads\n")
 	cm := GenInvalidMessage(0, 0)
+	cm.err = err
 	cli.readBuf.Insert(cm)
 	if setFlag {
 		cli.stopAppFlag = true
@@ -336,37 +1298,193 @@ func (cli *LspClient) stopApp(setFlag bool) {
 
 
 func (cli *LspClient) iRead() ([]byte, error) {
-	m := <- cli.appReadChan
+	var m *LspMessage
+	select {
+	case m = <- cli.appReadChan:
+	case <- cli.loopDone:
+		// Loop may have handed over results before finishing
+		select {
+		case m = <- cli.appReadChan:
+		default:
+			return nil, cli.closedErr()
+		}
+	}
 	switch m.Type {
 	case MsgDATA:
-		return m.Payload, nil
+		// Payload now belongs to application
+		payload := m.Payload
+		releaseMessage(m)
+		return payload, nil
 	case MsgINVALID:
-		// Indicates that read should fail
-		// Recycle message so that future reads will also fail
-		cli.appReadChan <- m
-		return nil, lsplog.ConnectionClosed()
+		// Indicates that read should fail, either because application
+		// closed connection or because contact was lost
+		if m.err != nil {
+			return nil, m.err
+		}
+		return nil, lsplog.ConnectionLost(cli.lspConn.connId, lsplog.ErrTimeout)
 	}
-	return nil, lsplog.ConnectionClosed()
+	return nil, lsplog.ConnectionClosed(cli.lspConn.connId)
 }
 
-func (cli *LspClient) iWrite(payload []byte) error {
+func (cli *LspClient) iWrite(payload []byte, opts WriteOptions) error {
+	if len(payload) > MaxPayloadSize {
+		return lsplog.PayloadTooLarge(len(payload), MaxPayloadSize)
+	}
+	if opts.Done != nil {
+		if err := holdRoom(opts.Done); err != nil {
+			return err
+		}
+	}
 	// Will fill in ID & sequence number later
-	m := GenDataMessage(0, 0, payload)
-	cli.appWriteChan <- m
-	rm := <- cli.writeReplyChan
-	lsplog.Vlogf(5, "Completed write of %s", string(payload))
-	if rm != nil {
-		// Recycle so that subsequent writes will get error
-		cli.writeReplyChan <- rm
+	m := newSentMessage(0, payload, opts.Done, writeTTL(opts, cli.params.Load()))
+	select {
+	case cli.appWriteChan <- m:
+	case <- cli.loopDone:
+		releaseSent(m)
+		return cli.closedErr()
+	}
+	var rm error
+	select {
+	case rm = <- cli.writeReplyChan:
+	case <- cli.loopDone:
+		rm = cli.closedErr()
+	}
+	if lsplog.Enabled(5) {
+		lsplog.Vlogf(5, "Completed write of %s", string(payload))
 	}
 	return rm
 }
 
+// Run f in client's loop, and wait for it.  Returns false if loop has
+// already finished
+func (cli *LspClient) query(f func()) bool {
+	done := make(chan bool)
+	select {
+	case cli.queryChan <- func() { f(); close(done) }:
+		<- done
+		return true
+	case <- cli.loopDone:
+		return false
+	}
+}
+
+func (cli *LspClient) iSetParams(params *LspParams) error {
+	params = withDefaults(params)
+	if err := checkParams(params); err != nil {
+		return err
+	}
+	old := cli.params.Load()
+	if params.Clock != old.Clock {
+		return lsplog.MakeErr("Clock can't change once client is running")
+	}
+	cli.params.Store(params)
+	if !cli.query(func() { cli.setParams(params) }) {
+		return cli.closedErr()
+	}
+	return nil
+}
+
+// Take up new epoch length & limit.  Runs in loop
+func (cli *LspClient) setParams(params *LspParams) {
+	con := cli.lspConn
+	if ms := params.EpochMilliseconds; ms != con.caps.EpochMilliseconds {
+		cli.Vlogf(3, "Changing epochs from %vms to %vms\n", con.caps.EpochMilliseconds, ms)
+		con.rescale(cli.currentEpoch, con.caps.EpochMilliseconds, ms)
+		con.caps.EpochMilliseconds = ms
+		select {
+		case <- cli.epochReset:
+		default:
+		}
+		cli.epochReset <- ms
+	}
+	con.epochLimit = params.EpochLimit
+	con.caps.EpochLimit = params.EpochLimit
+	con.compressMin = compressMin(params)
+	con.noDelay = params.NoDelay
+	if con.caps.FEC {
+		con.fec = fecStripes(params)
+	}
+	cli.coalesceMs = params.CoalesceMilliseconds
+	if con.held && !con.coalescing() {
+		cli.flushHeld()
+	}
+	if cli.status.EpochLimit != params.EpochLimit {
+		cli.status.EpochLimit = params.EpochLimit
+		cli.publish()
+	}
+}
+
+func (cli *LspClient) iSetNoDelay(noDelay bool) error {
+	ok := cli.query(func() {
+		con := cli.lspConn
+		con.noDelay = noDelay
+		if noDelay && con.held {
+			cli.flushHeld()
+		}
+	})
+	if !ok {
+		return cli.closedErr()
+	}
+	return nil
+}
+
+func (cli *LspClient) iSetFEC(stripes int) error {
+	if err := checkFEC(stripes); err != nil {
+		return err
+	}
+	var err error
+	ok := cli.query(func() {
+		con := cli.lspConn
+		if stripes > 0 && !con.caps.FEC {
+			err = lsplog.MakeErr("Server doesn't support FEC")
+			return
+		}
+		con.fec = stripes
+	})
+	if !ok {
+		return cli.closedErr()
+	}
+	return err
+}
+
+func (cli *LspClient) iFlush() error {
+	done := make(chan error, 1)
+	m := newFlushMessage(0, done)
+	select {
+	case cli.appWriteChan <- m:
+	case <- cli.loopDone:
+		releaseMessage(m)
+		return cli.closedErr()
+	}
+	select {
+	case err := <- done:
+		return err
+	case <- cli.loopDone:
+		// Loop may have replied before finishing
+		select {
+		case err := <- done:
+			return err
+		default:
+			return cli.closedErr()
+		}
+	}
+}
+
+// Why connection ended.  Only valid once loop has finished
+func (cli *LspClient) closedErr() error {
+	if cli.lspConn.closeErr != nil {
+		return cli.lspConn.closeErr
+	}
+	return lsplog.ConnectionClosed(cli.lspConn.connId)
+}
+
+// Returns once every internal goroutine has finished
 func (cli *LspClient) iClose() {
 	m := GenInvalidMessage(0, 0)
-	cli.appWriteChan <- m
-	<- cli.closeReplyChan
-	// Put back nil, so that subsequent closes will succeed
-	cli.closeReplyChan <- nil
+	select {
+	case cli.appWriteChan <- m:
+	case <- cli.loopDone:
+	}
+	<- cli.loopDone
+	cli.goroutines.Wait()
 }
-
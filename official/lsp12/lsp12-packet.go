@@ -1,8 +1,20 @@
 package lsp12
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Internal message types.  Never sent over network
+const (
+	msgFLUSH = 0xff // Application waiting for its writes to be acknowledged
+	msgDRAIN = 0xfe // Application wants server to stop taking connections
+	msgHANDOFF = 0xfd // Application handing connections to another process
+	msgHOLD = 0xfc // Stop passing received messages to application
 )
 
 var typeName = map [byte] string {
@@ -10,11 +22,19 @@ var typeName = map [byte] string {
 	MsgDATA: "Data",
 	MsgACK: "Ack",
 	MsgINVALID: "Invalid",
+	MsgSKIP: "Skip",
+	MsgBUNDLE: "Bundle",
+	MsgPROBE: "Probe",
+	MsgSTRIPE: "Stripe",
+	msgFLUSH: "Flush",
+	msgDRAIN: "Drain",
+	msgHANDOFF: "Handoff",
+	msgHOLD: "Hold",
 }
 
 // Construct message.  General form
 func GenMessage(t byte,  id uint16, seqnum byte, data []byte) *LspMessage {
-	return &LspMessage{t, id, seqnum, data}
+	return &LspMessage{Type: t, ConnId: id, SeqNum: seqnum, Payload: data}
 }
 
 // Construct connection request message.
@@ -38,18 +58,222 @@ func GenInvalidMessage(id uint16, seqnum byte) *LspMessage {
 	return GenMessage(MsgINVALID, id, seqnum, nil)	
 }
 
-// Extract message from packet
-func extractMessage(packet []byte)  (*LspMessage, error) {
-	var m LspMessage
-	err := json.Unmarshal(packet, &m)
-	return &m, err
+// Extract first message from datagram, and return the rest, which
+// holds any further messages.  Message comes from pool, and its
+// payload is a fresh buffer that does not alias datagram
+func extractMessage(packet []byte)  (*LspMessage, []byte, error) {
+	m := newMessage()
+	if rest, ok := parsePacket(packet, m); ok {
+		return m, rest, nil
+	}
+	// Not in the form we generate.  Let the JSON package deal with it
+	*m = LspMessage{}
+	err := json.Unmarshal(packet, m)
+	return m, nil, err
+}
+
+// Pack message into packet, appending to b.
+// Produces exactly what json.Marshal would, without allocating
+func (msg *LspMessage) appendPacket(b []byte) []byte {
+	b = append(b, `{"Type":`...)
+	b = strconv.AppendUint(b, uint64(msg.Type), 10)
+	b = append(b, `,"ConnId":`...)
+	b = strconv.AppendUint(b, uint64(msg.ConnId), 10)
+	b = append(b, `,"SeqNum":`...)
+	b = strconv.AppendUint(b, uint64(msg.SeqNum), 10)
+	b = append(b, `,"Payload":`...)
+	if msg.Payload == nil {
+		b = append(b, "null}"...)
+		return b
+	}
+	b = append(b, '"')
+	n := base64.StdEncoding.EncodedLen(len(msg.Payload))
+	for cap(b) - len(b) < n + 2 {
+		b = append(b[:cap(b)], 0)[:len(b)]
+	}
+	base64.StdEncoding.Encode(b[len(b):len(b)+n], msg.Payload)
+	b = b[:len(b)+n]
+	b = append(b, '"', '}')
+	return b
+}
+
+// Decode packet in the exact form generated by appendPacket, from
+// start of datagram p.  Returns what follows, once the newline
+// separating coalesced packets is skipped.
+// Returns false if packet is in any other form
+func parsePacket(p []byte, m *LspMessage) ([]byte, bool) {
+	var t, id, sn uint64
+	var ok bool
+	if p, ok = skipPrefix(p, `{"Type":`); !ok { return nil, false }
+	if t, p, ok = parseUint(p, 0xff); !ok { return nil, false }
+	if p, ok = skipPrefix(p, `,"ConnId":`); !ok { return nil, false }
+	if id, p, ok = parseUint(p, 0xffff); !ok { return nil, false }
+	if p, ok = skipPrefix(p, `,"SeqNum":`); !ok { return nil, false }
+	if sn, p, ok = parseUint(p, 0xff); !ok { return nil, false }
+	if p, ok = skipPrefix(p, `,"Payload":`); !ok { return nil, false }
+	m.Type = byte(t)
+	m.ConnId = uint16(id)
+	m.SeqNum = byte(sn)
+	if rest, ok := skipPrefix(p, "null}"); ok {
+		m.Payload = nil
+		return nextPacket(rest)
+	}
+	if len(p) < 3 || p[0] != '"' {
+		return nil, false
+	}
+	// Base64 has no quotes, so payload ends at the next one
+	end := bytes.IndexByte(p[1:], '"') + 1
+	if end == 0 || end + 1 >= len(p) || p[end+1] != '}' {
+		return nil, false
+	}
+	rest, ok := nextPacket(p[end+2:])
+	if !ok {
+		return nil, false
+	}
+	src := p[1:end]
+	buf := getPayload(base64.StdEncoding.DecodedLen(len(src)))
+	n, err := base64.StdEncoding.Decode(buf, src)
+	if err != nil {
+		ReleasePayload(buf)
+		return nil, false
+	}
+	m.Payload = buf[:n]
+	return rest, true
+}
+
+// What follows packet in datagram: nothing, or a newline and the next
+func nextPacket(p []byte) ([]byte, bool) {
+	if len(p) == 0 {
+		return nil, true
+	}
+	if len(p) > 1 && p[0] == '\n' {
+		return p[1:], true
+	}
+	return nil, false
+}
+
+func skipPrefix(p []byte, prefix string) ([]byte, bool) {
+	if len(p) < len(prefix) || string(p[:len(prefix)]) != prefix {
+		return p, false
+	}
+	return p[len(prefix):], true
+}
+
+// Parse unsigned decimal no greater than max
+func parseUint(p []byte, max uint64) (uint64, []byte, bool) {
+	var v uint64
+	i := 0
+	for i < len(p) && p[i] >= '0' && p[i] <= '9' {
+		v = v*10 + uint64(p[i]-'0')
+		if v > max { return 0, p, false }
+		i++
+	}
+	return v, p[i:], i > 0
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Buffer pools
+//
+// Ownership rules:
+// - Write copies its payload into a pooled buffer.  The caller may reuse
+//   its slice as soon as Write returns.
+// - Read hands over a payload that belongs to the caller, and is never
+//   touched again by LSP.  When done with it, the caller may pass it to
+//   ReleasePayload so that it can be reused for a later message.  After
+//   that, the caller must not use the slice.  Payloads that are never
+//   released are simply garbage collected.
+
+var messagePool = sync.Pool{New: func() interface{} { return new(LspMessage) }}
+
+// Get cleared message from pool
+func newMessage() *LspMessage {
+	return messagePool.Get().(*LspMessage)
+}
+
+// Return message to pool.  Payload is not released
+func releaseMessage(m *LspMessage) {
+	*m = LspMessage{}
+	messagePool.Put(m)
+}
+
+// Largest packet LSP sends, which sizes buffers for sending & receiving
+const maxPacketSize = 1500
+
+// Longest possible packet apart from payload
+const maxPacketHeader = len(`{"Type":255,"ConnId":65535,"SeqNum":255,"Payload":""}`)
+
+// Largest payload that fits in a single packet once base64 encoded
+const MaxPayloadSize = (maxPacketSize - maxPacketHeader) / 4 * 3
+
+var packetPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 2*maxPacketSize)
+	return &b
+}}
+
+// Payload buffers come in power-of-two size classes
+const (
+	minPayloadClass = 6  // 64 bytes
+	maxPayloadClass = 16 // 64K
+	maxPayloadFree  = 256 // Buffers kept per class
+)
+
+type payloadClass struct {
+	lock sync.Mutex
+	free [][]byte
+}
+
+var payloadClasses [maxPayloadClass+1]payloadClass
+
+func payloadClassOf(n int) int {
+	c := minPayloadClass
+	for c <= maxPayloadClass && 1<<uint(c) < n {
+		c++
+	}
+	return c
+}
+
+// Get buffer of length n
+func getPayload(n int) []byte {
+	c := payloadClassOf(n)
+	if c > maxPayloadClass {
+		return make([]byte, n)
+	}
+	pc := &payloadClasses[c]
+	pc.lock.Lock()
+	if k := len(pc.free); k > 0 {
+		b := pc.free[k-1]
+		pc.free = pc.free[:k-1]
+		pc.lock.Unlock()
+		return b[:n]
+	}
+	pc.lock.Unlock()
+	return make([]byte, n, 1<<uint(c))
+}
+
+// Hand payload returned by Read back to LSP for reuse.
+// Caller must not use payload afterwards
+func ReleasePayload(payload []byte) {
+	c := payloadClassOf(cap(payload))
+	if c > maxPayloadClass || cap(payload) != 1<<uint(c) {
+		// Not one of ours
+		return
+	}
+	pc := &payloadClasses[c]
+	pc.lock.Lock()
+	if len(pc.free) < maxPayloadFree {
+		pc.free = append(pc.free, payload[:0])
+	}
+	pc.lock.Unlock()
 }
 
-// Pack message into packet
-func (msg *LspMessage) genPacket() ([]byte) {
-	p, err := json.Marshal(msg)
-	if err != nil { return nil }
-	return p
+// Copy payload into pooled buffer.  Keeps nil distinct from empty
+func copyPayload(payload []byte) []byte {
+	if payload == nil {
+		return nil
+	}
+	b := getPayload(len(payload))
+	copy(b, payload)
+	return b
 }
 
 // Show string representation of message
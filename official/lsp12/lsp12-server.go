@@ -2,304 +2,926 @@ package lsp12
 
 import (
 	"P3-f12/official/lsplog"
-	"P3-f12/official/lspnet"
+	"cmp"
 	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 // Input stream from network must include source address
 type networkData struct {
 	msg *LspMessage
-	addr *lspnet.UDPAddr
+	addr netip.AddrPort
+	kept bool // Message has been queued for application
 }
 
 type networkChan chan *networkData
 
+var networkDataPool = sync.Pool{New: func() interface{} { return new(networkData) }}
+
+func newNetworkData(msg *LspMessage, addr netip.AddrPort) *networkData {
+	d := networkDataPool.Get().(*networkData)
+	d.msg = msg
+	d.addr = addr
+	d.kept = false
+	return d
+}
+
+// Recycle network input once it has been handled.  Message and its
+// payload are recycled too, unless they have been queued for application
+func releaseNetworkData(d *networkData) {
+	if !d.kept {
+		ReleasePayload(d.msg.Payload)
+		releaseMessage(d.msg)
+	}
+	d.msg = nil
+	networkDataPool.Put(d)
+}
+
 type iLspServer struct {
+	params atomic.Pointer[LspParams] // Replaced by SetParams.  Shards keep own copy
+	transport PacketTransport
+	// Connections are divided among shards, each with its own event loop.
+	// Connection connId belongs to shards[connId % len(shards)]
+	shards []*serverShard
+	appReadChan LspMessageChan   // Supply results for Read function
+	netDone chan bool // Closed when all network operations terminate
+	closed chan bool // Closed once server has completely shut down
+	holding chan bool // Closed once handoff begins and reads stop
+	shardWait sync.WaitGroup // Shard loops still running
+	goroutines sync.WaitGroup // All internal goroutines
+	// Draining
+	drainLock sync.Mutex
+	drained chan struct{} // Closed once draining shards have no connections
+	drainWait sync.WaitGroup // Shards still with connections
+}
+
+// State owned by a single event loop goroutine
+type serverShard struct {
+	srv *LspServer
+	index int
 	nextId uint16
 	params *LspParams
-	udpConn *lspnet.UDPConn
-	readBuf *Buf  // Results that are ready to be read
-	appReadChan LspMessageChan   // Supply results for Read function
+	readBuf *Queue[*LspMessage] // Results that are ready to be read
+	appReadChan LspMessageChan   // Shared with other shards
 	appWriteChan LspMessageChan  // Requests to write or close
 	netInChan networkChan // Inputs from network
-	epochChan chan int  // For triggering epochs
-	currentEpoch int64
-	connById map[uint16] *lspConn  // All active connections, indexed by connId
-	connByAddr map[string] *lspConn // All active connections, indexed by hostport
-	stopGlobalNetworkFlag bool // All network operations terminate
+	epochChan chan int  // For triggering ticks
+	epochReset chan int // For changing tick length
+	currentEpoch int64 // In ticks, which are epochs unless clients propose their own
+	timers *timerWheel // Per-connection retransmission & liveness timers
+	connById map[uint16] *lspConn  // Connections in this shard, indexed by connId
+	connByAddr map[netip.AddrPort] *lspConn // Connections in this shard, indexed by address
+	closedErrs map[uint16] error // Why deleted connections ended, until ID reused
+	badAddrCount int64 // Packets dropped because source didn't match connection
+	outOfIdsCount int64 // Connection requests refused for want of an ID
 	stopAppFlag bool
+	stopFlag bool // Shard loop should finish.  Only touched by loop
+	draining bool // Refusing new connections
+	holdFlag bool // Keeping received messages from application, for handoff
+	drainSignalled bool // Have told server that no connections remain
+	drainTimer *wheelTimer // Fires when remaining connections should close
+	done chan bool // Closed when shard loop has finished
 	// For communicating results back to function calls
-	closeReplyChan chan error
-	closeAllReplyChan chan error
 	writeReplyChan chan error
+	writeLock sync.Mutex // One Write at a time, so that reply goes to right caller
+	handoffChan chan []*handoffConn // Connections to pass to successor
+	holdChan chan error // Signals that shard has stopped handing over results
+	queryChan chan func() // Functions to run in loop on behalf of application
+	held []*lspConn // Connections with output held back for coalescing
+	coalesceArm chan int // Start coalescing timer
+	coalesceFire chan int // Coalescing timer has run out
+	coalesceArmed bool
 }
 
 func iNewLspServer(port int, params *LspParams) (*LspServer, error) {
-	srv := new(LspServer)
-	srv.nextId = 1
-	if params == nil {
-		// Insert default parameters
-		params = &LspParams{5,2000}
-	}
-	srv.params = params
-	hostport := fmt.Sprintf(":%v", port)
-	addr, err := lspnet.ResolveUDPAddr("udp", hostport)
-	if lsplog.CheckReport(1, err) {
-		return nil, err
-	}
-	srv.udpConn, err = lspnet.ListenUDP("udp", addr)
+	return iNewLspServerAddr("udp", fmt.Sprintf(":%v", port), params)
+}
+
+func iNewLspServerAddr(network, address string, params *LspParams) (*LspServer, error) {
+	t, err := ListenUDPTransport(network, address)
 	if lsplog.CheckReport(1, err) {
 		return nil, err
 	}
-	srv.readBuf = NewBuf()
-	// Need enough room to recycle close messages
+	return iNewLspServerTransport(t, params), nil
+}
+
+func iNewLspServerTransport(t PacketTransport, params *LspParams) *LspServer {
+	srv := newLspServer(t, params)
+	srv.start()
+	return srv
+}
+
+// Set up server on transport, without starting it
+func newLspServer(t PacketTransport, params *LspParams) *LspServer {
+	srv := new(LspServer)
+	params = withDefaults(params)
+	srv.params.Store(params)
+	srv.transport = t
 	srv.appReadChan = make(LspMessageChan, 1)
-	srv.appWriteChan = make(LspMessageChan)
-	srv.netInChan = make(networkChan)
-	srv.epochChan = make(chan int)
-	srv.connById = make(map[uint16] *lspConn)
-	srv.connByAddr = make(map[string] *lspConn)
-	srv.closeReplyChan = make(chan error, 1)
-	srv.closeAllReplyChan = make(chan error, 1)
-	srv.writeReplyChan = make(chan error, 1)
+	srv.netDone = make(chan bool)
+	srv.closed = make(chan bool)
+	srv.holding = make(chan bool)
+	n := params.ServerShards
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	srv.shards = make([]*serverShard, n)
+	for i := range srv.shards {
+		srv.shards[i] = srv.newShard(i)
+	}
+	return srv
+}
+
+// Launch goroutines for shards & network
+func (srv *LspServer) start() {
+	n := len(srv.shards)
+	srv.shardWait.Add(n)
+	for _, sh := range srv.shards {
+		sh := sh
+		spawn(&srv.goroutines, sh.serverLoop)
+		spawn(&srv.goroutines, srv.udpReader)
+		clock, ms := paramsClock(sh.params), tickMilliseconds(sh.params)
+		startEpochTrigger(&srv.goroutines, clock, ms, sh.epochChan, sh.epochReset, sh.done)
+		spawn(&srv.goroutines, func() {
+			coalesceTimer(clock, sh.coalesceArm, sh.coalesceFire, sh.done)
+		})
+	}
+	spawn(&srv.goroutines, srv.awaitShards)
+}
+
+func (srv *LspServer) newShard(index int) *serverShard {
+	sh := new(serverShard)
+	sh.srv = srv
+	sh.index = index
+	sh.nextId = uint16(index)
+	sh.params = srv.params.Load()
+	sh.readBuf = NewQueue[*LspMessage](0)
+	sh.appReadChan = srv.appReadChan
+	sh.appWriteChan = make(LspMessageChan)
+	sh.netInChan = make(networkChan, 64)
+	sh.epochChan = make(chan int)
+	sh.epochReset = make(chan int, 1)
+	sh.connById = make(map[uint16] *lspConn)
+	sh.connByAddr = make(map[netip.AddrPort] *lspConn)
+	sh.closedErrs = make(map[uint16] error)
+	sh.timers = newTimerWheel(0)
+	sh.drainTimer = newWheelTimer(sh.drainTimeout)
+	sh.done = make(chan bool)
+	sh.writeReplyChan = make(chan error, 1)
+	sh.handoffChan = make(chan []*handoffConn, 1)
+	sh.holdChan = make(chan error, 1)
+	sh.queryChan = make(chan func())
+	sh.coalesceArm = make(chan int, 1)
+	sh.coalesceFire = make(chan int)
+	return sh
+}
+
+// Shard owning connection
+func (srv *LspServer) shardForId(id uint16) *serverShard {
+	return srv.shards[int(id) % len(srv.shards)]
+}
 
-	go srv.serverLoop()
-	go srv.udpReader()
-	go epochTrigger(srv.params.EpochMilliseconds, srv.epochChan, &srv.stopGlobalNetworkFlag)
-	return srv, nil
+// Shard handling connection requests from address.
+// Connections it opens get IDs that map back to the same shard
+func (srv *LspServer) shardForAddr(addr netip.AddrPort) *serverShard {
+	var h uint32 = 2166136261
+	ip := addr.Addr().As16()
+	for _, c := range ip {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	h = (h ^ uint32(addr.Port())) * 16777619
+	return srv.shards[h % uint32(len(srv.shards))]
+}
+
+// Once every shard has finished, shut down network and notify CloseAll
+func (srv *LspServer) awaitShards() {
+	srv.shardWait.Wait()
+	srv.stopGlobalNetwork()
+	close(srv.closed)
 }
 
 // Main server loop
-func (srv *LspServer) serverLoop() {
-	for !(srv.stopAppFlag && srv.stopGlobalNetworkFlag) {
+func (sh *serverShard) serverLoop() {
+	for !sh.stopFlag {
 		var id uint16 = 0
 		// Filter out any invalid messages from front of read buffer
-		srv.filterReadBuf()
-		if srv.readBuf.Empty() {
+		sh.filterReadBuf()
+		if sh.readBuf.Empty() || sh.holdFlag {
 			select {
-			case netd := <-srv.netInChan:
-				id = srv.handleNetMessage(netd)
-			case appm := <-srv.appWriteChan:
-				id = srv.handleAppWrite(appm)
-			case <- srv.epochChan:
-				srv.handleEpoch()
+			case netd := <-sh.netInChan:
+				id = sh.handleNetMessage(netd)
+				releaseNetworkData(netd)
+			case appm := <-sh.appWriteChan:
+				id = sh.handleAppWrite(appm)
+			case n := <- sh.epochChan:
+				if n > 0 {
+					sh.handleEpoch()
+				}
+			case f := <- sh.queryChan:
+				f()
+			case <- sh.coalesceFire:
+				sh.coalesceArmed = false
+				sh.flushHeld()
 			}
 		} else {
-			v := srv.readBuf.Front()
-			rm := v.(*LspMessage)
+			rm := sh.readBuf.Front()
+			// Message belongs to application once handed over
+			rtype, rid := rm.Type, rm.ConnId
 			select {
-			case netm := <-srv.netInChan:
-				id = srv.handleNetMessage(netm)
-			case appm := <-srv.appWriteChan:
-				id = srv.handleAppWrite(appm)
-			case <- srv.epochChan:
-				srv.handleEpoch()
-			case srv.appReadChan <- rm:
-				srv.readBuf.Remove()
+			case netd := <-sh.netInChan:
+				id = sh.handleNetMessage(netd)
+				releaseNetworkData(netd)
+			case appm := <-sh.appWriteChan:
+				id = sh.handleAppWrite(appm)
+			case n := <- sh.epochChan:
+				if n > 0 {
+					sh.handleEpoch()
+				}
+			case f := <- sh.queryChan:
+				f()
+			case <- sh.coalesceFire:
+				sh.coalesceArmed = false
+				sh.flushHeld()
+			case sh.appReadChan <- rm:
+				sh.readBuf.Remove()
+				id = sh.handedOver(rtype, rid)
 			}
 		}
-		srv.checkToSend(id)
+		sh.checkToSend(id)
+		if len(sh.held) > 0 && sh.params.CoalesceMilliseconds <= 0 {
+			sh.flushHeld()
+		}
 	}
-	srv.closeAllReplyChan <- nil
+	sh.checkDrained()
+	close(sh.done)
+	sh.srv.shardWait.Done()
 }
 
 // Receive message from network.  If status changes for connection, return id
-func (srv *LspServer) handleNetMessage(netd *networkData) uint16 {
+func (sh *serverShard) handleNetMessage(netd *networkData) uint16 {
 	netm := netd.msg
 	id := netm.ConnId
-	con := srv.connById[id]
+	con := sh.connById[id]
 	if con == nil {
 		if netm.Type != MsgCONNECT {
-			srv.Vlogf(6, "Message with invalid Id %v received\n",
+			sh.Vlogf(6, "Message with invalid Id %v received\n",
 				netm.ConnId)
 			return 0
 		} 
-	} else {
-		con.lastHeardEpoch = srv.currentEpoch
+	} else if netm.Type != MsgCONNECT {
+		if !sh.validSource(con, netd.addr) {
+			sh.badAddrCount++
+			sh.Vlogf(3, "Dropping %s from %v.  Connection %v registered to %v (%v dropped)\n",
+				netm, netd.addr, id, con.addr, sh.badAddrCount)
+			return 0
+		}
+		sh.heard(con)
 	}
 	switch netm.Type {
 	case MsgCONNECT:
 		if netm.SeqNum != 0 {
-			srv.Vlogf(6, "Connection request with invalid sequence number %v\n",
+			sh.Vlogf(6, "Connection request with invalid sequence number %v\n",
 				netm.SeqNum)
 			return 0
 		}
 		// See if already have connection with this address:
 		addr := netd.addr
-		saddr := addr.String()
-		ccon := srv.connByAddr[saddr] 
+		ccon := sh.connByAddr[addr] 
 		if ccon != nil {
-			srv.Vlogf(5, "Duplicate connection request from %s.  Resending Ack\n",
-				saddr)
+			sh.Vlogf(5, "Duplicate connection request from %v.  Resending Ack\n",
+				addr)
 			// Resend acknowledgement
-			srv.udpWrite(ccon, ccon.lastAck)
-			ccon.lastHeardEpoch = srv.currentEpoch
+			sh.udpWrite(ccon, ccon.lastAck)
+			sh.heard(ccon)
+			return 0
+		}
+		if sh.draining {
+			sh.refuse(addr, "Server draining")
+			return 0
+		}
+		offer, err := parseOffer(netm.Payload)
+		if err != nil {
+			sh.refuse(addr, "Malformed connection request")
+			return 0
+		}
+		caps, reason := negotiate(offer, localCapabilities(sh.params))
+		if reason != "" {
+			sh.refuse(addr, reason)
 			return 0
 		}
+		caps.EpochMilliseconds, caps.EpochLimit = clampTiming(offer, sh.params)
 		// New connection
-		id = srv.nextId
-		srv.nextId++
-		con := newConn(addr, id, srv.currentEpoch)
-		srv.connById[id] = con
-		srv.connByAddr[saddr] = con
+		id = sh.allocId()
+		if id == 0 {
+			// Other shards may have IDs to spare, but duplicate
+			// requests from addr would not find connection there
+			sh.outOfIdsCount++
+			sh.Vlogf(1, "No connection IDs left (%v requests refused)\n", sh.outOfIdsCount)
+			sh.refuse(addr, "No connection IDs left")
+			return 0
+		}
+		con := sh.newServerConn(addr, id, caps)
+		sh.connById[id] = con
+		sh.connByAddr[addr] = con
+		if pt, ok := sh.srv.transport.(peerTracker); ok {
+			pt.own(addr)
+		}
 		// Data messages start with seqnum 1
 		con.nextSendSeqNum = NextSeqNum(0)
 		con.nextRecvSeqNum = NextSeqNum(0)
-		srv.Vlogf(3, "Opening connection %d to %s\n", id, saddr)
-		// Send acknowledgement
-		con.lastAck = GenAckMessage(id, 0)
-		srv.udpWrite(con, con.lastAck)
+		sh.Vlogf(3, "Opening connection %d to %v, protocol version %v, epochs of %vms\n",
+			id, addr, caps.Version, caps.EpochMilliseconds)
+		// Send acknowledgement, with what has been agreed
+		con.setAck(0)
+		con.lastAck.Payload = agreedPayload(caps)
+		sh.udpWrite(con, con.lastAck)
 		return id
-	case MsgDATA:
+	case MsgDATA, MsgSKIP, MsgBUNDLE, MsgSTRIPE:
 		n := con.nextRecvSeqNum
 		if con.readDoneFlag {
-			srv.Vlogf(6, "Ignoring data message on %v.  Connection closed\n", con.connId)
+			sh.Vlogf(6, "Ignoring data message on %v.  Connection closed\n", con.connId)
 		} else if netm.SeqNum == n {
-			srv.readBuf.Insert(netm)
+			if netm.Type == MsgSTRIPE {
+				// Stripe now belongs to connection.  Carry on with
+				// message once rebuilt
+				netd.kept = true
+				if netm = con.addStripe(netm); netm == nil {
+					return 0
+				}
+				netd.msg, netd.kept = netm, false
+			}
+			if netm.Type == MsgDATA && !con.decode(netm) {
+				sh.Vlogf(1, "Dropping data message #%v on %v.  Can't decode payload\n",
+					n, con.connId)
+				return 0
+			}
+			// Skip only uses up sequence number
+			switch netm.Type {
+			case MsgDATA:
+				sh.readBuf.Insert(netm)
+				netd.kept = true
+			case MsgBUNDLE:
+				if !con.unbundle(netm, sh.readBuf) {
+					sh.Vlogf(1, "Dropping bundle #%v on %v.  Can't split it\n",
+						n, con.connId)
+					return 0
+				}
+			}
 			con.nextRecvSeqNum = NextSeqNum(n)
 			// Generate acknowledgement
-			con.lastAck = GenAckMessage(con.connId, n)
-			srv.udpWrite(con, con.lastAck)
-			srv.Vlogf(5, "Received & acknowledged %s\n", netm)
+			con.setAck(n)
+			sh.sendAck(con)
+			if lsplog.Enabled(5) {
+				sh.Vlogf(5, "Received & acknowledged %s\n", netm)
+			}
 		} else {
-			srv.Vlogf(6, "Ignoring data message #%v on %v.  Expecting %v\n",
+			sh.Vlogf(6, "Ignoring data message #%v on %v.  Expecting %v\n",
 				netm.SeqNum, con.connId, n)
+			// Our ack may have been lost.  Repeat it
+			sh.resendAck(con)
 			return 0 // Will not enable new send
 		}
+	case MsgPROBE:
+		if con.writeDoneFlag {
+			return 0
+		}
+		if netm.Payload != nil {
+			a := probeAnswer(netm)
+			sh.udpWrite(con, &a)
+		} else {
+			sh.sendProbe(con, con.probeAnswered(netm, sh.currentEpoch))
+			sh.timers.schedule(con.probeTimer, con.probeAt)
+		}
+		return 0
 	case MsgACK:
 		if con.pendingMsg == nil {
-			srv.Vlogf(6, "Ignoring ack message #%v on %v.  No pending message\n",
-				netm.SeqNum, con.connId)
+			if lsplog.Enabled(6) {
+				sh.Vlogf(6, "Ignoring ack message #%v on %v.  No pending message\n",
+					netm.SeqNum, con.connId)
+			}
+			// Keep-alive from client.  Answer with our last ack
+			sh.resendAck(con)
 			return 0
 		}
 		n := con.pendingMsg.SeqNum
 		if netm.SeqNum == n {
-			srv.Vlogf(5, "Acknowledement %v received on connection %v\n",
-				n, id)
-			con.pendingMsg = nil
+			if lsplog.Enabled(5) {
+				sh.Vlogf(5, "Acknowledement %v received on connection %v\n",
+					n, id)
+			}
+			con.acked()
+			sh.timers.cancel(con.resendTimer)
 			return id
 		} else {
-			srv.Vlogf(6, "Ignoring ack message #%v.  Expecting %v\n",
+			sh.Vlogf(6, "Ignoring ack message #%v.  Expecting %v\n",
 				netm.SeqNum, n)
+			sh.resendAck(con)
 			return 0
 		}
 	default:
-		srv.Vlogf(6, "Ignoring message of type %s\n", typeName[netm.Type])
+		sh.Vlogf(6, "Ignoring message of type %s\n", typeName[netm.Type])
 		return 0
 	}
 	return 0
 }
 
+// Find unused connection ID belonging to this shard, skipping 0.
+// Returns 0 when all are taken
+func (sh *serverShard) allocId() uint16 {
+	step := uint16(len(sh.srv.shards))
+	for i := 0; i <= (1<<16) / int(step); i++ {
+		id := sh.nextId
+		sh.nextId += step
+		if sh.nextId < step {
+			// Wrapped around
+			sh.nextId = uint16(sh.index)
+		}
+		if id != 0 && sh.connById[id] == nil {
+			delete(sh.closedErrs, id)
+			return id
+		}
+	}
+	return 0
+}
+
+// Check that packet for existing connection came from the address
+// registered when the connection was opened.  Connections never
+// migrate, so any other source is forged or stale
+func (sh *serverShard) validSource(con *lspConn, addr netip.AddrPort) bool {
+	return addr == con.addr
+}
+
 // Process write or close
-func (srv *LspServer) handleAppWrite(appm *LspMessage) uint16 {
+func (sh *serverShard) handleAppWrite(appm *LspMessage) uint16 {
 	id := appm.ConnId
-	con := srv.connById[id]
-	if con == nil {
-		if id == 0 && appm.Type == MsgINVALID {
-			srv.Vlogf(1, "Application requesting shutdown of server\n")
-			for _, con := range srv.connById {
+	con := sh.connById[id]
+	switch appm.Type {
+	case  MsgDATA:
+		if err := sh.writeErr(id, con); err != nil {
+			sh.Vlogf(6, "Refusing write of %s: %v\n", appm, err)
+			releaseSent(appm)
+			sh.writeReplyChan <- err
+			return 0
+		}
+		if len(appm.Payload) > con.caps.MaxPayload {
+			releaseSent(appm)
+			sh.writeReplyChan <- lsplog.PayloadTooLarge(len(appm.Payload), con.caps.MaxPayload)
+			return 0
+		}
+		// Queue message to send over network
+		idle := con.pendingMsg == nil && con.sendBuf.Empty()
+		appm.Payload = con.encode(appm.Payload)
+		if con.queue(appm, sh.currentEpoch) {
+			sh.timers.schedule(con.expireTimer, con.nextExpiry)
+		}
+		if idle && con.coalescing() && sh.params.CoalesceMilliseconds > 0 {
+			// Nothing ahead of it.  Wait for company
+			con.holdData = true
+			sh.hold(con)
+		}
+		sh.writeReplyChan <- nil
+	case msgFLUSH:
+		if err := sh.writeErr(id, con); err != nil {
+			notify(appm.notify, err)
+		} else {
+			con.flush(appm.notify)
+		}
+		releaseMessage(appm)
+		return 0
+	case msgDRAIN:
+		sh.Vlogf(1, "Draining shard with %v connections\n", len(sh.connById))
+		sh.draining = true
+		if appm.expires > 0 {
+			sh.timers.schedule(sh.drainTimer,
+				sh.currentEpoch + appm.expires * sh.ticksFor(sh.params.EpochMilliseconds))
+		} else {
+			sh.timers.cancel(sh.drainTimer)
+		}
+		releaseMessage(appm)
+		sh.checkDrained()
+		return 0
+	case msgHOLD:
+		releaseMessage(appm)
+		sh.holdFlag = true
+		notify(sh.holdChan, nil)
+		return 0
+	case msgHANDOFF:
+		releaseMessage(appm)
+		sh.handOff()
+		return 0
+	case MsgINVALID:
+		if id == 0 {
+			sh.Vlogf(1, "Application requesting shutdown of shard\n")
+			for _, con := range sh.connById {
 				// Initiate closing of this connection
-				srv.readDone(con)
+				sh.readDone(con)
 			}
-			srv.stopApp()
-		} else if id != 0 && appm.Type == MsgINVALID {
+			sh.stopApp()
+			return 0
+		}
+		if con == nil {
 			// Call to close on already closed connection.
-			srv.Vlogf(6, "Application called close on nonexistent (possibly closed) connection.\n")
+			sh.Vlogf(6, "Application called close on nonexistent (possibly closed) connection.\n")
 // Not needed for nonblocking close
-//			srv.closeReplyChan <- nil
-		} else {
-			srv.Vlogf(6, "Message %s has invalid connection Id\n", appm, id)
+//			sh.closeReplyChan <- nil
+			return 0
 		}
-		return 0
-	}
-	switch appm.Type {
-	case  MsgDATA:
-		// Queue message to send over network
-		con.sendBuf.Insert(appm)
-		srv.writeReplyChan <- nil
-	case MsgINVALID:
 		// Initiate closing of this connection
-		srv.readDone(con)
+		sh.readDone(con)
 	default:
 		// Shouldn't happen
-		srv.Vlogf(6, "Unexpected message type %s from app write\n",
+		sh.Vlogf(6, "Unexpected message type %s from app write\n",
 		typeName[appm.Type])
 	}
 	return id
 }
 
-// Process epoch event
-func (srv *LspServer) handleEpoch() {
-	srv.currentEpoch ++
-	for _, con := range srv.connById {
-		if con.writeDoneFlag {
-			continue
+// Why application can no longer send on connection, or nil if it can
+func (sh *serverShard) writeErr(id uint16, con *lspConn) error {
+	if sh.stopAppFlag {
+		return lsplog.ServerClosed()
+	}
+	if con != nil {
+		// Closing, or lost and waiting for application to notice
+		return con.closeErr
+	}
+	if err, ok := sh.closedErrs[id]; ok {
+		return err
+	}
+	return lsplog.UnknownConnection(id)
+}
+
+// Message has been passed to application.  If it reported loss of
+// connection, then there's nothing more to read.  Returns id if
+// connection status changed
+func (sh *serverShard) handedOver(t byte, id uint16) uint16 {
+	if t != MsgINVALID || id == 0 {
+		return 0
+	}
+	con := sh.connById[id]
+	if con == nil || con.readDoneFlag {
+		return 0
+	}
+	sh.readDone(con)
+	return id
+}
+
+// Drain deadline reached.  Close whatever connections remain
+func (sh *serverShard) drainTimeout() {
+	sh.Vlogf(1, "Drain deadline reached.  Closing %v connections\n", len(sh.connById))
+	for _, con := range sh.connById {
+		if !con.readDoneFlag {
+			sh.readDone(con)
 		}
-		if int(srv.currentEpoch - con.lastHeardEpoch) > srv.params.EpochLimit {
-			srv.Vlogf(3, "Epoch limit of %v exceeded on connection %v.\n",
-				srv.params.EpochLimit, con.connId)
-			srv.writeDone(con)
+	}
+}
+
+// Let server know once a draining shard has no connections left, or
+// has stopped after handing them over to a successor
+func (sh *serverShard) checkDrained() {
+	if sh.draining && !sh.drainSignalled && (len(sh.connById) == 0 || sh.stopFlag) {
+		sh.drainSignalled = true
+		sh.srv.drainWait.Done()
+	}
+}
+
+// Process tick.  Only connections with timers due are visited
+func (sh *serverShard) handleEpoch() {
+	sh.currentEpoch ++
+	sh.timers.advance(sh.currentEpoch)
+	// See if it's time to shut down this shard
+	if sh.stopAppFlag && len(sh.connById) == 0 {
+		sh.stopFlag = true
+	}
+}
+
+// Set up connection along with its timers, timed as agreed in caps
+func (sh *serverShard) newServerConn(addr netip.AddrPort, id uint16, caps Capabilities) *lspConn {
+	con := newConn(addr, id, sh.currentEpoch)
+	// Fill in any timing left out, as by older versions
+	if caps.EpochMilliseconds <= 0 {
+		caps.EpochMilliseconds = sh.params.EpochMilliseconds
+	}
+	if caps.EpochLimit <= 0 {
+		caps.EpochLimit = sh.params.EpochLimit
+	}
+	con.caps = caps
+	con.codec = agreedCodec(caps)
+	con.compressMin = compressMin(sh.params)
+	con.coalesce = caps.Coalesce
+	con.noDelay = sh.params.NoDelay
+	if caps.FEC {
+		con.fec = fecStripes(sh.params)
+	}
+	con.epochLimit = caps.EpochLimit
+	sh.setEpochTicks(con)
+	con.liveTimer = newWheelTimer(func() { sh.liveTimeout(con) })
+	con.resendTimer = newWheelTimer(func() { sh.resendTimeout(con) })
+	con.expireTimer = newWheelTimer(func() { sh.expireTimeout(con) })
+	con.probeTimer = newWheelTimer(func() { sh.probeTimeout(con) })
+	sh.timers.schedule(con.liveTimer, sh.liveDeadline(con))
+	if caps.PathProbe {
+		// Client hears of connection ID first
+		con.startProbing(sh.currentEpoch + 1)
+		sh.timers.schedule(con.probeTimer, con.probeAt)
+	}
+	return con
+}
+
+// Ticks in shortest epoch clients may propose
+const ticksPerEpoch = 10
+
+// Length of shard's tick.  Connections are timed in whole ticks, which
+// are the server's epochs, unless clients may propose epoch lengths.
+// Then ticks are fine enough to time the shortest allowed closely
+func tickMilliseconds(params *LspParams) int {
+	ms := params.EpochMilliseconds
+	if params.MinEpochMilliseconds <= 0 && params.MaxEpochMilliseconds <= 0 {
+		return ms
+	}
+	if params.MinEpochMilliseconds > 0 {
+		ms = min(ms, params.MinEpochMilliseconds)
+	}
+	return max(ms / ticksPerEpoch, 1)
+}
+
+// Ticks of shard in ms milliseconds, rounded
+func (sh *serverShard) ticksFor(ms int) int64 {
+	tick := tickMilliseconds(sh.params)
+	return int64(max((ms + tick/2) / tick, 1))
+}
+
+// Count connection's epoch in ticks of shard
+func (sh *serverShard) setEpochTicks(con *lspConn) {
+	con.epochTicks = sh.ticksFor(con.caps.EpochMilliseconds)
+}
+
+// Epoch at which connection is declared lost if nothing more is heard
+func (sh *serverShard) liveDeadline(con *lspConn) int64 {
+	return con.lastHeardEpoch + int64(con.epochLimit + 1) * con.epochTicks
+}
+
+// Epoch at which unacknowledged message is sent again
+func (sh *serverShard) resendDeadline(con *lspConn) int64 {
+	return sh.currentEpoch + con.epochTicks
+}
+
+// Record that have heard from other end of connection
+func (sh *serverShard) heard(con *lspConn) {
+	con.lastHeardEpoch = sh.currentEpoch
+	if !con.writeDoneFlag {
+		sh.timers.schedule(con.liveTimer, sh.liveDeadline(con))
+	}
+}
+
+// Nothing heard from client for too long
+func (sh *serverShard) liveTimeout(con *lspConn) {
+	if con.writeDoneFlag {
+		return
+	}
+	sh.Vlogf(3, "Epoch limit of %v exceeded on connection %v.\n",
+		con.epochLimit, con.connId)
+	con.closeErr = lsplog.ConnectionLost(con.connId, lsplog.ErrTimeout)
+	sh.writeDone(con)
+}
+
+// Pending message still not acknowledged after an epoch
+func (sh *serverShard) resendTimeout(con *lspConn) {
+	pm := con.pendingMsg
+	if pm == nil || con.writeDoneFlag {
+		return
+	}
+	sh.Vlogf(6, "Resending message %s\n", pm)
+	con.resent++
+	sh.sendData(con, pm)
+	sh.timers.schedule(con.resendTimer, sh.resendDeadline(con))
+}
+
+// Some queued message has run out of time
+func (sh *serverShard) expireTimeout(con *lspConn) {
+	n, skipped := con.expire(sh.currentEpoch)
+	if n > 0 {
+		sh.Vlogf(2, "Dropped %v expired writes on %v (%v in all)\n",
+			n, con.connId, con.expired)
+	}
+	if skipped {
+		if lsplog.Enabled(4) {
+			sh.Vlogf(4, "Pending message #%v on %v expired.  Sending skip\n",
+				con.pendingMsg.SeqNum, con.connId)
+		}
+		sh.udpWrite(con, con.pendingMsg)
+		sh.timers.schedule(con.resendTimer, sh.resendDeadline(con))
+	}
+	if con.nextExpiry != 0 {
+		sh.timers.schedule(con.expireTimer, con.nextExpiry)
+	}
+}
+
+// Write message as k stripes, with parity if FEC is on.  Any
+// acknowledgement held back goes along with the first and the last
+func (sh *serverShard) sendStripes(con *lspConn, msg *LspMessage, k int) {
+	scratch := getPayload(stripeRoom(msg, k))
+	bp := packetPool.Get().(*[]byte)
+	ack := con.ackDue
+	con.ackDue = false
+	last := k - 1
+	if con.fec > 0 {
+		last = k
+	}
+	for i := 0; i <= last; i++ {
+		s := stripeOf(scratch, msg, k, i)
+		b, split := (*bp)[:0], 0
+		if ack && (i == 0 || i == last) {
+			b, split = appendCoalesced(b, con.lastAck, &s, con.packetLimit())
 		} else {
-			pm := con.pendingMsg
-			if pm != nil {
-				srv.Vlogf(6, "Resending message %s\n", pm)
-				srv.udpWrite(con, pm)
-			}
-			am := con.lastAck
-			if am != nil {
-				srv.Vlogf(6, "Resending ack #%v on connection %v\n",
-					am.SeqNum, am.ConnId)
-				srv.udpWrite(con, am)
-			}
+			b = s.appendPacket(b)
 		}
+		sh.writeCoalesced(con.addr, b, split)
+		*bp = b[:0]
+	}
+	packetPool.Put(bp)
+	ReleasePayload(scratch)
+}
+
+// Path MTU probe due, or unanswered
+func (sh *serverShard) probeTimeout(con *lspConn) {
+	if con.writeDoneFlag {
+		return
+	}
+	sh.sendProbe(con, con.probeDue(sh.currentEpoch))
+	sh.timers.schedule(con.probeTimer, con.probeAt)
+}
+
+// Send probe of given size, unless 0
+func (sh *serverShard) sendProbe(con *lspConn, size int) {
+	if size == 0 {
+		return
 	}
-	// See if it's time to shut down entire network
-	if srv.stopAppFlag && len(srv.connById) == 0 {
-		srv.stopGlobalNetwork()
+	bp := packetPool.Get().(*[]byte)
+	b := con.appendProbe((*bp)[:0], size)
+	if lsplog.Enabled(6) {
+		sh.Vlogf(6, "Probing path to %v with %v bytes\n", con.connId, len(b))
+	}
+	sh.writePacket(con.addr, b)
+	*bp = b[:0]
+	packetPool.Put(bp)
+}
+
+// Turn down connection request, telling client why
+func (sh *serverShard) refuse(addr netip.AddrPort, reason string) {
+	sh.Vlogf(3, "Refusing connection request from %v.  %s\n", addr, reason)
+	m := GenInvalidMessage(0, 0)
+	m.Payload = []byte(reason)
+	sh.udpWriteTo(addr, m)
+}
+
+// Repeat last acknowledgement.  Server only does this in response to
+// the client, whose own epochs drive keep-alives and retransmissions
+func (sh *serverShard) resendAck(con *lspConn) {
+	am := con.lastAck
+	if am != nil && !con.writeDoneFlag {
+		if lsplog.Enabled(6) {
+			sh.Vlogf(6, "Resending ack #%v on connection %v\n",
+				am.SeqNum, am.ConnId)
+		}
+		sh.udpWrite(con, am)
 	}
 }
 
 
 // See if we can send any messages for given Id
-func (srv *LspServer) checkToSend(id uint16) {
+func (sh *serverShard) checkToSend(id uint16) {
 	if id == 0 { return }
-	con := srv.connById[id]
+	con := sh.connById[id]
 	if con == nil {
-		srv.Vlogf(6, "Unexpected Id %v for checkToSend\n", id)
+		sh.Vlogf(6, "Unexpected Id %v for checkToSend\n", id)
 		return
 	} 
 	if !con.sendBuf.Empty() && con.pendingMsg == nil {
-		d := con.sendBuf.Remove()
-		sm := d.(*LspMessage)
+		if con.holdData {
+			if !con.bundleFull() {
+				return
+			}
+			con.holdData = false
+		}
+		sm := con.nextToSend()
 		n := con.nextSendSeqNum
 		con.nextSendSeqNum = NextSeqNum(n)
 		sm.ConnId = con.connId
 		sm.SeqNum = n
 		if sm.Type == MsgINVALID {
 			// Have cleared out send buffer
-			srv.writeDone(con)
+			sh.writeDone(con)
 		} else {
 			con.pendingMsg = sm
-			srv.Vlogf(6, "Sending message %s\n", sm)
-			srv.udpWrite(con, sm)
+			if lsplog.Enabled(6) {
+				sh.Vlogf(6, "Sending message %s\n", sm)
+			}
+			sh.sendData(con, sm)
+			sh.timers.schedule(con.resendTimer, sh.resendDeadline(con))
 		}
 	}
 }
 
+// Acknowledge data.  When coalescing, hold acknowledgement back so
+// that it can go along with data
+func (sh *serverShard) sendAck(con *lspConn) {
+	if con.coalescing() {
+		con.ackDue = true
+		sh.hold(con)
+	} else {
+		sh.writeAck(con)
+	}
+}
+
+// Write acknowledgement.  With FEC, twice, since it can't be rebuilt
+func (sh *serverShard) writeAck(con *lspConn) {
+	sh.udpWrite(con, con.lastAck)
+	if con.fec > 0 {
+		sh.udpWrite(con, con.lastAck)
+	}
+}
+
+// Note that connection has output held back, and start timer if needed
+func (sh *serverShard) hold(con *lspConn) {
+	if !con.held {
+		con.held = true
+		sh.held = append(sh.held, con)
+	}
+	ms := sh.params.CoalesceMilliseconds
+	if ms > 0 && !sh.coalesceArmed {
+		sh.coalesceArmed = true
+		sh.coalesceArm <- ms
+	}
+}
+
+// Send whatever connections have held back
+func (sh *serverShard) flushHeld() {
+	for _, con := range sh.held {
+		con.held = false
+		con.holdData = false
+		if con.writeDoneFlag || sh.connById[con.connId] != con {
+			continue
+		}
+		sh.checkToSend(con.connId)
+		if con.ackDue {
+			con.ackDue = false
+			sh.writeAck(con)
+		}
+	}
+	clear(sh.held)
+	sh.held = sh.held[:0]
+}
+
+// Write data message to transport, along with any acknowledgement
+// held back
+func (sh *serverShard) sendData(con *lspConn, msg *LspMessage) {
+	if k := con.stripesFor(msg); k > 0 {
+		sh.sendStripes(con, msg, k)
+		return
+	}
+	if !con.ackDue {
+		sh.udpWrite(con, msg)
+		return
+	}
+	con.ackDue = false
+	bp := packetPool.Get().(*[]byte)
+	b, split := appendCoalesced((*bp)[:0], con.lastAck, msg, con.packetLimit())
+	sh.writeCoalesced(con.addr, b, split)
+	*bp = b[:0]
+	packetPool.Put(bp)
+}
+
+// Write datagram packed by appendCoalesced, as two if it had to split
+func (sh *serverShard) writeCoalesced(addr netip.AddrPort, b []byte, split int) {
+	if split == 0 {
+		sh.writePacket(addr, b)
+	} else {
+		sh.writePacket(addr, b[:split-1])
+		sh.writePacket(addr, b[split:])
+	}
+}
+
 // Filter out any invalid messages from front of read buffer
-func (srv *LspServer) filterReadBuf() {
-	for !srv.readBuf.Empty() {
-		v := srv.readBuf.Front()
-		rm := v.(*LspMessage)
+func (sh *serverShard) filterReadBuf() {
+	for !sh.readBuf.Empty() {
+		rm := sh.readBuf.Front()
 		id := rm.ConnId
-		con := srv.connById[id]
+		con := sh.connById[id]
 		if rm.Type == MsgINVALID {
 			// Keep message there
 			return
 		}
 		if con == nil || con.readDoneFlag == true {
-			srv.readBuf.Remove()
-			srv.Vlogf(6, "Filtering out received message for closed connection '%s'\n", rm)
+			sh.readBuf.Remove()
+			sh.Vlogf(6, "Filtering out received message for closed connection '%s'\n", rm)
+			ReleasePayload(rm.Payload)
+			releaseMessage(rm)
 		} else {
 			break
 		}
@@ -308,59 +930,100 @@ func (srv *LspServer) filterReadBuf() {
 
 
 
-// Write message to UDP connection.  Address specified by con
-func (srv *LspServer) udpWrite(con *lspConn, msg *LspMessage) {
-	b := msg.genPacket()
-	_, err := srv.udpConn.WriteToUDP(b, con.addr)
+// Write message to transport.  Address specified by con
+func (sh *serverShard) udpWrite(con *lspConn, msg *LspMessage) {
+	sh.udpWriteTo(con.addr, msg)
+}
+
+func (sh *serverShard) udpWriteTo(addr netip.AddrPort, msg *LspMessage) {
+	bp := packetPool.Get().(*[]byte)
+	b := msg.appendPacket((*bp)[:0])
+	sh.writePacket(addr, b)
+	*bp = b[:0]
+	packetPool.Put(bp)
+}
+
+func (sh *serverShard) writePacket(addr netip.AddrPort, b []byte) {
+	_, err := sh.srv.transport.WriteTo(b, addr)
 	if lsplog.CheckReport(6, err) {
-		srv.Vlogf(6, "Write failed\n")
+		sh.Vlogf(6, "Write failed\n")
 	}
 }
 
 
-// Goroutine that reads messages from UDP connection and writes to message channel
+// Goroutine that reads messages from transport and writes to message channel.
+// Runs until network stopped
 func (srv *LspServer) udpReader() {
-	udpConn := srv.udpConn
-	netc := srv.netInChan
-	var buffer [1500] byte
-	for !srv.stopGlobalNetworkFlag {
-		n, addr, err := udpConn.ReadFromUDP(buffer[0:])
-		if lsplog.CheckReport(1, err) {
+	t := srv.transport
+	var buffer [maxPacketSize] byte
+	for {
+		n, addr, err := t.ReadFrom(buffer[0:])
+		if err != nil {
+			select {
+			case <- srv.netDone:
+				// Socket closed under us
+				return
+			default:
+			}
+			lsplog.CheckReport(1, err)
 			srv.Vlogf(5, "Server continuing\n")
 			continue
 		}
-		m, merr := extractMessage(buffer[0:n])
-		if lsplog.CheckReport(1, merr) {
-			srv.Vlogf(6, "Server continuing\n")
-			continue
+		// Datagram may hold several coalesced messages
+		for p := buffer[0:n]; len(p) > 0; {
+			m, rest, merr := extractMessage(p)
+			p = rest
+			if lsplog.CheckReport(1, merr) {
+				srv.Vlogf(6, "Server continuing\n")
+				break
+			}
+			if lsplog.Enabled(5) {
+				srv.Vlogf(5, "Received message %s\n", m)
+			}
+			d := newNetworkData(m, addr)
+			var sh *serverShard
+			if m.Type == MsgCONNECT {
+				sh = srv.shardForAddr(addr)
+			} else {
+				sh = srv.shardForId(m.ConnId)
+			}
+			select {
+			case sh.netInChan <- d:
+			case <- sh.done:
+				// Shard has finished.  Drop message
+				releaseNetworkData(d)
+			}
 		}
-		srv.Vlogf(5, "Received message %s\n", m)
-		d := &networkData{m,addr}
-		netc <- d
 	}
 }
 
 // Reporting from server
 func (srv *LspServer) Vlogf(level int, format string, v ...interface{}) {
+	if !lsplog.Enabled(level) {
+		return
+	}
 	nformat := fmt.Sprintf("S: %s", format)
 	lsplog.Vlogf(level, nformat, v...)
 }
 
 // Shut down all network activity
 func(srv *LspServer) stopGlobalNetwork() {
-	srv.stopGlobalNetworkFlag = true
-	err := srv.udpConn.Close()
+	close(srv.netDone)
+	err := srv.transport.Close()
 	if lsplog.CheckReport(4, err) {
 		lsplog.Vlogf(6, "Server Continuing\n")
 	}
 }
 
 // Mark that have completed all reads for connection
-func (srv *LspServer) readDone(con *lspConn) {
-	srv.Vlogf(6, "Reads done for connection %v\n", con.connId)
+func (sh *serverShard) readDone(con *lspConn) {
+	sh.Vlogf(6, "Reads done for connection %v\n", con.connId)
 	con.readDoneFlag = true
+	if con.closeErr == nil {
+		con.closeErr = lsplog.ConnectionClosed(con.connId)
+	}
 	if con.writeDoneFlag || (con.pendingMsg == nil && con.sendBuf.Empty()) {
-		srv.deleteConnection(con)
+		sh.deleteConnection(con)
 	} else {
 		// Insert message into send buffer to detect when writes are done
 		m := GenInvalidMessage(con.connId, 0)
@@ -369,79 +1032,439 @@ func (srv *LspServer) readDone(con *lspConn) {
 }
 
 // Mark that have completed all writes for connection
-func (srv *LspServer) writeDone(con *lspConn) {
-	srv.Vlogf(6, "Writes done for connection %v\n", con.connId)
+func (sh *serverShard) writeDone(con *lspConn) {
+	sh.Vlogf(6, "Writes done for connection %v\n", con.connId)
 	con.writeDoneFlag = true
 	if con.readDoneFlag {
-		srv.deleteConnection(con)
+		sh.deleteConnection(con)
 	} else {
-		// Insert message into read buffer to detect when read done
+		// Insert message into read buffer to detect when read done,
+		// carrying reason for read to report
 		m := GenInvalidMessage(con.connId, 0)
-		srv.readBuf.Insert(m)
+		m.err = con.closeErr
+		sh.readBuf.Insert(m)
 		// Disable sending or resending any more messages
+		con.failUnacked(con.closeErr)
 		con.pendingMsg = nil
+		sh.cancelTimers(con)
 	}
 }
 
 // Delete connection
-func (srv *LspServer) deleteConnection(con *lspConn) {
-	srv.Vlogf(6, "Deleting connection %v\n", con.connId)
-	delete(srv.connById, con.connId)
-	delete(srv.connByAddr, con.addr.String())
+func (sh *serverShard) deleteConnection(con *lspConn) {
+	sh.Vlogf(6, "Deleting connection %v\n", con.connId)
+	sh.cancelTimers(con)
+	con.failUnacked(con.closeErr)
+	delete(sh.connById, con.connId)
+	delete(sh.connByAddr, con.addr)
+	if pt, ok := sh.srv.transport.(peerTracker); ok {
+		pt.forget(con.addr)
+	}
+	sh.closedErrs[con.connId] = con.closeErr
+	sh.checkDrained()
 }
 
-// Shut down app activity
-func(srv *LspServer) stopApp() {
-	// Send close message to application
-	cm := GenInvalidMessage(0, 0)
-	srv.readBuf.Insert(cm)
-	srv.stopAppFlag = true
+// Stop all timers for connection
+func (sh *serverShard) cancelTimers(con *lspConn) {
+	sh.timers.cancel(con.liveTimer)
+	sh.timers.cancel(con.resendTimer)
+	sh.timers.cancel(con.expireTimer)
+	sh.timers.cancel(con.probeTimer)
 }
 
+// Shut down app activity.  Server sends final close message to
+// application once all shards have finished
+func (sh *serverShard) stopApp() {
+	sh.stopAppFlag = true
+}
+
+// Reporting from shard
+func (sh *serverShard) Vlogf(level int, format string, v ...interface{}) {
+	if !lsplog.Enabled(level) {
+		return
+	}
+	nformat := fmt.Sprintf("S%v: %s", sh.index, format)
+	lsplog.Vlogf(level, nformat, v...)
+}
+
+
+func (srv *LspServer) iLocalAddr() net.Addr {
+	return srv.transport.LocalAddr()
+}
 
 func (srv *LspServer) iRead() (uint16, []byte, error) {
-	m := <- srv.appReadChan
+	var m *LspMessage
+	select {
+	case m = <- srv.appReadChan:
+	case <- srv.closed:
+		// Shards may have handed over results before finishing
+		select {
+		case m = <- srv.appReadChan:
+		default:
+			return 0, nil, lsplog.ServerClosed()
+		}
+	case <- srv.holding:
+		// Handing off.  Shards have stopped handing over results
+		select {
+		case m = <- srv.appReadChan:
+		default:
+			return 0, nil, lsplog.ServerClosed()
+		}
+	}
 	switch m.Type {
 	case MsgDATA:
-		return m.ConnId, m.Payload, nil
+		// Payload now belongs to application
+		id, payload := m.ConnId, m.Payload
+		releaseMessage(m)
+		return id, payload, nil
 	case MsgINVALID:
-		// Indicates that read should fail.
-		return m.ConnId, nil, lsplog.ConnectionClosed()
+		// Indicates that read should fail.  Connection 0 signals that
+		// server has shut down.  Otherwise, connection ended for reason
+		// carried in marker
+		if m.ConnId == 0 {
+			return 0, nil, lsplog.ServerClosed()
+		}
+		if m.err != nil {
+			return m.ConnId, nil, m.err
+		}
+		return m.ConnId, nil, lsplog.ConnectionLost(m.ConnId, lsplog.ErrTimeout)
 	}
-	return m.ConnId, nil, lsplog.ConnectionClosed()
+	return m.ConnId, nil, lsplog.ConnectionClosed(m.ConnId)
 }
 
-func (srv *LspServer) iWrite(connId uint16, payload []byte) error {
-	m := GenDataMessage(connId, 0, payload)
-	srv.appWriteChan <- m
-	rm := <- srv.writeReplyChan
+func (srv *LspServer) iWrite(connId uint16, payload []byte, opts WriteOptions) error {
+	if connId == 0 {
+		return lsplog.UnknownConnection(connId)
+	}
+	if len(payload) > MaxPayloadSize {
+		return lsplog.PayloadTooLarge(len(payload), MaxPayloadSize)
+	}
+	if opts.Done != nil {
+		if err := holdRoom(opts.Done); err != nil {
+			return err
+		}
+	}
+	m := newSentMessage(connId, payload, opts.Done, writeTTL(opts, srv.params.Load()))
+	sh := srv.shardForId(connId)
+	sh.writeLock.Lock()
+	defer sh.writeLock.Unlock()
+	select {
+	case sh.appWriteChan <- m:
+	case <- sh.done:
+		// Server has shut down
+		releaseSent(m)
+		return lsplog.ServerClosed()
+	}
+	// Loop always replies to data message before it can finish
+	rm := <- sh.writeReplyChan
 	return rm
 }
 
+// Run f in shard's loop, and wait for it.  Returns false if shard has
+// already finished
+func (sh *serverShard) query(f func()) bool {
+	done := make(chan bool)
+	select {
+	case sh.queryChan <- func() { f(); close(done) }:
+		<- done
+		return true
+	case <- sh.done:
+		return false
+	}
+}
+
+func (srv *LspServer) iCapabilities(connId uint16) (Capabilities, error) {
+	var caps Capabilities
+	var err error
+	sh := srv.shardForId(connId)
+	ok := sh.query(func() {
+		if con := sh.connById[connId]; con != nil {
+			caps = con.caps
+		} else {
+			err = sh.writeErr(connId, nil)
+		}
+	})
+	if !ok {
+		return caps, lsplog.ServerClosed()
+	}
+	return caps, err
+}
+
+func (srv *LspServer) iRemoteAddr(connId uint16) (netip.AddrPort, error) {
+	var addr netip.AddrPort
+	var err error
+	sh := srv.shardForId(connId)
+	ok := sh.query(func() {
+		if con := sh.connById[connId]; con != nil {
+			addr = unmapped(con.addr)
+		} else {
+			err = sh.writeErr(connId, nil)
+		}
+	})
+	if !ok {
+		return addr, lsplog.ServerClosed()
+	}
+	return addr, err
+}
+
+func (srv *LspServer) iConnections() []ConnInfo {
+	var conns []ConnInfo
+	for _, sh := range srv.shards {
+		sh.query(func() {
+			for _, con := range sh.connById {
+				conns = append(conns, sh.connInfo(con))
+			}
+		})
+	}
+	slices.SortFunc(conns, func(a, b ConnInfo) int {
+		return cmp.Compare(a.ConnId, b.ConnId)
+	})
+	return conns
+}
+
+func (srv *LspServer) iStats() ServerStats {
+	var st ServerStats
+	for _, sh := range srv.shards {
+		sh.query(func() {
+			st.BadSource += sh.badAddrCount
+			st.OutOfIds += sh.outOfIdsCount
+		})
+	}
+	return st
+}
+
+var connStateName = map [ConnState] string {
+	ConnOpen: "open",
+	ConnReadDone: "read-done",
+	ConnWriteDone: "write-done",
+}
+
+func (cs ConnState) String() string {
+	return connStateName[cs]
+}
+
+// Connection state appears by name in JSON
+func (cs ConnState) MarshalText() ([]byte, error) {
+	return []byte(cs.String()), nil
+}
+
+// Address as application expects to see it.  Dual-stack sockets report
+// IPv4 clients as IPv4-mapped IPv6
+func unmapped(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// Snapshot of connection.  Runs in loop
+func (sh *serverShard) connInfo(con *lspConn) ConnInfo {
+	ci := ConnInfo{
+		ConnId: con.connId,
+		RemoteAddr: unmapped(con.addr),
+		SinceHeard: (sh.currentEpoch - con.lastHeardEpoch) / con.epochTicks,
+		PathMTU: con.packetLimit(),
+		Resent: con.resent,
+		Rebuilt: con.rebuilt,
+		Expired: con.expired,
+	}
+	for m := range con.sendBuf.All() {
+		// Leave out close marker
+		if m.Type == MsgDATA {
+			ci.Queued++
+		}
+	}
+	if con.pendingMsg != nil {
+		ci.Pending = 1
+	}
+	if con.readDoneFlag {
+		ci.State = ConnReadDone
+	} else if con.writeDoneFlag {
+		ci.State = ConnWriteDone
+	}
+	return ci
+}
+
+func (srv *LspServer) iSetParams(params *LspParams) error {
+	params = withDefaults(params)
+	if err := checkParams(params); err != nil {
+		return err
+	}
+	old := srv.params.Load()
+	if (params.ServerShards != 0 && params.ServerShards != len(srv.shards)) || params.Clock != old.Clock {
+		return lsplog.MakeErr("ServerShards and Clock can't change once server is running")
+	}
+	params.ServerShards = old.ServerShards
+	srv.params.Store(params)
+	for _, sh := range srv.shards {
+		if !sh.query(func() { sh.setParams(params) }) {
+			return lsplog.ServerClosed()
+		}
+	}
+	return nil
+}
+
+// Take up new parameters.  Connections keep the epoch length agreed
+// with their clients, which time themselves by it, but take up the new
+// epoch limit.  Runs in loop
+func (sh *serverShard) setParams(params *LspParams) {
+	oldTick, tick := tickMilliseconds(sh.params), tickMilliseconds(params)
+	sh.params = params
+	now := sh.currentEpoch
+	if tick != oldTick {
+		sh.Vlogf(3, "Changing ticks from %vms to %vms\n", oldTick, tick)
+		select {
+		case <- sh.epochReset:
+		default:
+		}
+		sh.epochReset <- tick
+		if sh.drainTimer.active {
+			sh.timers.schedule(sh.drainTimer, rescaleEpoch(sh.drainTimer.when, now, oldTick, tick))
+		}
+	}
+	for _, con := range sh.connById {
+		if tick != oldTick {
+			con.rescale(now, oldTick, tick)
+			sh.setEpochTicks(con)
+			if con.pendingMsg != nil {
+				sh.timers.schedule(con.resendTimer, sh.resendDeadline(con))
+			}
+			if con.nextExpiry != 0 {
+				sh.timers.schedule(con.expireTimer, con.nextExpiry)
+			}
+			if con.caps.PathProbe && !con.writeDoneFlag {
+				sh.timers.schedule(con.probeTimer, con.probeAt)
+			}
+		}
+		_, con.caps.EpochLimit = clampTiming(con.caps, params)
+		con.epochLimit = con.caps.EpochLimit
+		con.compressMin = compressMin(params)
+		if !con.writeDoneFlag {
+			sh.timers.schedule(con.liveTimer, sh.liveDeadline(con))
+		}
+	}
+}
+
+func (srv *LspServer) iSetNoDelay(connId uint16, noDelay bool) error {
+	var err error
+	sh := srv.shardForId(connId)
+	ok := sh.query(func() {
+		con := sh.connById[connId]
+		if con == nil {
+			err = sh.writeErr(connId, nil)
+			return
+		}
+		con.noDelay = noDelay
+		if noDelay && con.held {
+			sh.flushHeld()
+		}
+	})
+	if !ok {
+		return lsplog.ServerClosed()
+	}
+	return err
+}
+
+func (srv *LspServer) iSetFEC(connId uint16, stripes int) error {
+	if err := checkFEC(stripes); err != nil {
+		return err
+	}
+	var err error
+	sh := srv.shardForId(connId)
+	ok := sh.query(func() {
+		con := sh.connById[connId]
+		if con == nil {
+			err = sh.writeErr(connId, nil)
+		} else if stripes > 0 && !con.caps.FEC {
+			err = lsplog.MakeErr(fmt.Sprintf("Client on connection %v doesn't support FEC", connId))
+		} else {
+			con.fec = stripes
+		}
+	})
+	if !ok {
+		return lsplog.ServerClosed()
+	}
+	return err
+}
+
+func (srv *LspServer) iFlush(connId uint16) error {
+	if connId == 0 {
+		return lsplog.UnknownConnection(connId)
+	}
+	done := make(chan error, 1)
+	m := newFlushMessage(connId, done)
+	sh := srv.shardForId(connId)
+	select {
+	case sh.appWriteChan <- m:
+	case <- sh.done:
+		releaseMessage(m)
+		return lsplog.ServerClosed()
+	}
+	select {
+	case err := <- done:
+		return err
+	case <- sh.done:
+		// Shard may have replied before finishing
+		select {
+		case err := <- done:
+			return err
+		default:
+			return lsplog.ServerClosed()
+		}
+	}
+}
+
 func (srv *LspServer) iCloseConn(connId uint16) {
 	if connId == 0 {
 		return
 	}
 	m := GenInvalidMessage(connId, 0)
-	srv.appWriteChan <- m
+	sh := srv.shardForId(connId)
+	select {
+	case sh.appWriteChan <- m:
+	case <- sh.done:
+	}
 // Not needed for nonblocking close
 //	<- srv.closeReplyChan
 }
 
-// Close all connections and terminate server
+func (srv *LspServer) iDrain(epochs int) <-chan struct{} {
+	srv.drainLock.Lock()
+	defer srv.drainLock.Unlock()
+	first := srv.drained == nil
+	if first {
+		srv.drained = make(chan struct{})
+		srv.drainWait.Add(len(srv.shards))
+		spawn(&srv.goroutines, func() {
+			srv.drainWait.Wait()
+			close(srv.drained)
+		})
+	}
+	// Repeated calls just replace the deadline
+	for _, sh := range srv.shards {
+		m := newMessage()
+		m.Type = msgDRAIN
+		m.expires = int64(epochs)
+		select {
+		case sh.appWriteChan <- m:
+		case <- sh.done:
+			// Shard has shut down, so has no connections
+			releaseMessage(m)
+			if first {
+				srv.drainWait.Done()
+			}
+		}
+	}
+	return srv.drained
+}
+
+// Close all connections and terminate server.
+// Returns once every internal goroutine has finished
 func (srv *LspServer) iCloseAll() {
-	// Notify server that want to close all connections
-	m := GenInvalidMessage(0, 0)
-	srv.appWriteChan <- m
-	done := false
-	// Skip over any connection closed replies
-	for !done {
+	// Notify every shard that want to close all connections
+	for _, sh := range srv.shards {
 		select {
-		case <- srv.closeReplyChan:
-		case <-srv.closeAllReplyChan:
-			done = true
+		case sh.appWriteChan <- GenInvalidMessage(0, 0):
+		case <- sh.done:
 		}
 	}
-	// Insert nil for subsequent closes
-	srv.closeAllReplyChan <- nil
+	<- srv.closed
+	srv.goroutines.Wait()
 }
@@ -0,0 +1,132 @@
+// Path MTU discovery.  When both ends support it, each searches for the
+// largest packet that gets through to the other, sending probes padded
+// to the size being tried, which the other end answers.  A probe that
+// goes unanswered for probeTries epochs in a row is taken as too large,
+// since tunnels often drop large packets without a word.
+// Sizes count the whole packet as handed to the transport.  Packets are
+// assumed to get through up to basePathMTU, until the first probe says
+// otherwise, in which case the search carries on down to minPathMTU.
+// It goes no higher than maxPacketSize, the largest packet LSP sends,
+// which also sizes receive buffers.
+// Bundles & shared datagrams are kept within the path MTU, and messages
+// too large for it are split into stripes.  See fec.go.  Only other ends
+// that don't support stripes get such messages whole, relying on IP
+// fragmentation.
+// Once the search is over, it is repeated every probeRecheck epochs,
+// starting by checking that the path still takes what it did
+package lsp12
+
+const (
+	minPathMTU = 576 // Every IPv4 host takes this much
+	basePathMTU = 1200 // Gets through nearly any path
+	probeStep = 16 // Search is over once answer is known to within this
+	probeTries = 3 // Unanswered probes of a size before giving up on it
+	probeRecheck = 300 // Epochs between searches
+)
+
+// Padding for probes.  Never written to
+var probePadding [MaxPayloadSize]byte
+
+// Start search, if other end answers probes.  Called once connected
+func (con *lspConn) startProbing(now int64) {
+	if !con.caps.PathProbe {
+		return
+	}
+	if con.pathMTU == 0 {
+		con.pathMTU = basePathMTU
+	}
+	con.probeHi = maxPacketSize + 1
+	con.mtuConfirmed = con.pathMTU <= minPathMTU
+	con.probeAt = now
+}
+
+// Packets up to this size can go to other end
+func (con *lspConn) packetLimit() int {
+	if con.pathMTU == 0 {
+		return maxPacketSize
+	}
+	return con.pathMTU
+}
+
+// Largest payload that fits in packet of given size
+func payloadRoom(size int) int {
+	return min((size - maxPacketHeader) / 4 * 3, MaxPayloadSize)
+}
+
+// Size of probe to send at epoch now, or 0 if none is due.
+// Call once probeAt is reached
+func (con *lspConn) probeDue(now int64) int {
+	if con.probeSize > 0 {
+		// Still no answer
+		con.probeTried++
+		if con.probeTried < probeTries {
+			con.probeAt = now + con.epochTicks
+			return con.probeSize
+		}
+		if con.mtuConfirmed {
+			con.probeHi = con.probeSize
+		} else if con.pathMTU > basePathMTU {
+			// Path no longer takes what it did.  Try the usual size
+			con.probeHi = con.pathMTU
+			con.pathMTU = basePathMTU
+		} else {
+			// Nor does it take that.  Search again from bottom
+			con.probeHi = con.pathMTU
+			con.pathMTU = minPathMTU
+			con.mtuConfirmed = true
+		}
+		con.probeSize = 0
+	}
+	return con.nextProbe(now)
+}
+
+// Answer to probe has arrived.  Returns size of next probe to send,
+// or 0 if none
+func (con *lspConn) probeAnswered(m *LspMessage, now int64) int {
+	if con.probeSize == 0 || m.SeqNum != con.probeSeq {
+		// Stale.  Have given up on that probe
+		return 0
+	}
+	con.pathMTU = con.probeSize
+	con.mtuConfirmed = true
+	con.probeSize = 0
+	return con.nextProbe(now)
+}
+
+// Pick size for next probe, or 0 once search is over
+func (con *lspConn) nextProbe(now int64) int {
+	size := con.pathMTU
+	if con.mtuConfirmed {
+		size = (con.pathMTU + con.probeHi) / 2
+	}
+	if con.mtuConfirmed && con.probeHi - con.pathMTU <= probeStep {
+		// Start again later
+		con.probeHi = maxPacketSize + 1
+		con.mtuConfirmed = con.pathMTU <= minPathMTU
+		con.probeAt = now + probeRecheck * con.epochTicks
+		return 0
+	}
+	con.probeSeq++
+	con.probeSize = size
+	con.probeTried = 0
+	con.probeAt = now + con.epochTicks
+	return size
+}
+
+// Pack probe of at most size bytes, appending to b.  Records actual
+// size, which base64 can leave up to 3 bytes short
+func (con *lspConn) appendProbe(b []byte, size int) []byte {
+	m := LspMessage{Type: MsgPROBE, ConnId: con.connId, SeqNum: con.probeSeq}
+	start := len(b)
+	m.Payload = probePadding[:0]
+	header := len(m.appendPacket(b)) - start
+	m.Payload = probePadding[:min((size - header) / 4 * 3, MaxPayloadSize)]
+	b = m.appendPacket(b)
+	con.probeSize = len(b) - start
+	return b
+}
+
+// Answer to probe: no payload, same sequence number
+func probeAnswer(m *LspMessage) LspMessage {
+	return LspMessage{Type: MsgPROBE, ConnId: m.ConnId, SeqNum: m.SeqNum}
+}
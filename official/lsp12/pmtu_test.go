@@ -0,0 +1,138 @@
+package lsp12
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// Run search for epochs, from epoch now, over path that takes packets
+// up to limit and answers at once.  Returns each path MTU taken in turn
+func searchPath(con *lspConn, limit int, now, epochs int64) []int {
+	mtus := []int{con.packetLimit()}
+	taken := func() {
+		if mtu := con.packetLimit(); mtu != mtus[len(mtus) - 1] {
+			mtus = append(mtus, mtu)
+		}
+	}
+	for end := now + epochs; now < end; now++ {
+		if now < con.probeAt {
+			continue
+		}
+		size := con.probeDue(now)
+		taken()
+		for size > 0 && len(con.appendProbe(nil, size)) <= limit {
+			answer := probeAnswer(&LspMessage{Type: MsgPROBE, SeqNum: con.probeSeq})
+			size = con.probeAnswered(&answer, now)
+			taken()
+		}
+	}
+	return mtus
+}
+
+// Search settles within a step of what path takes, falling back to the
+// usual size, then the minimum, when larger probes go unanswered
+func TestPathSearch(t *testing.T) {
+	tests := []struct {
+		name string
+		start int // Path MTU from earlier search, or 0
+		limit int // Largest packet path takes
+		falls []int // Path MTUs taken before search climbs again
+	}{
+		{"wide", 0, 1500, []int{1200}},
+		{"usual", 0, 1200, []int{1200}},
+		{"narrow", 0, 1000, []int{1200, 576}},
+		{"minimum", 0, 576, []int{1200, 576}},
+		{"narrowed to usual", 1500, 1300, []int{1500, 1200}},
+		{"narrowed to minimum", 1500, 576, []int{1500, 1200, 576}},
+	}
+	for _, tc := range tests {
+		con := newConn(netip.AddrPort{}, 1, 0)
+		con.caps.PathProbe = true
+		con.pathMTU = tc.start
+		con.startProbing(0)
+		mtus := searchPath(con, tc.limit, 0, probeRecheck)
+		if n := len(tc.falls); len(mtus) < n || !reflect.DeepEqual(mtus[:n], tc.falls) {
+			t.Errorf("%s: path MTU went %v, want %v first", tc.name, mtus, tc.falls)
+		}
+		if mtu := con.packetLimit(); mtu > tc.limit || mtu < min(tc.limit, maxPacketSize) - probeStep {
+			t.Errorf("%s: path MTU %v for path taking %v", tc.name, mtu, tc.limit)
+		}
+		if con.probeSize != 0 || con.probeAt < probeRecheck {
+			t.Errorf("%s: search not over", tc.name)
+		}
+	}
+}
+
+// Repeated search finds that path has narrowed, and drops from
+// what it found before, through the usual size, to the minimum
+func TestPathRecheck(t *testing.T) {
+	con := newConn(netip.AddrPort{}, 1, 0)
+	con.caps.PathProbe = true
+	con.startProbing(0)
+	searchPath(con, maxPacketSize, 0, probeRecheck)
+	found := con.packetLimit()
+	if found < maxPacketSize - probeStep {
+		t.Fatalf("path MTU %v for path taking %v", found, maxPacketSize)
+	}
+	mtus := searchPath(con, minPathMTU, probeRecheck, 2 * probeRecheck)
+	if want := []int{found, basePathMTU, minPathMTU}; !reflect.DeepEqual(mtus, want) {
+		t.Errorf("path MTU went %v, want %v", mtus, want)
+	}
+}
+
+// Transport dropping packets larger than limit
+type narrowTransport struct {
+	PacketTransport
+	limit atomic.Int32
+}
+
+func (t *narrowTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	if len(b) > int(t.limit.Load()) {
+		return len(b), nil
+	}
+	return t.PacketTransport.WriteTo(b, addr)
+}
+
+// Client falls back below the usual size over path that won't take it,
+// and large writes still get through.  Climb from minimum can follow
+// too soon to be seen
+func TestPathFallback(t *testing.T) {
+	params := &LspParams{EpochLimit: 20, EpochMilliseconds: 100}
+	r := newRig(t, params, nil)
+	narrow := &narrowTransport{}
+	narrow.limit.Store(800)
+	cli := r.connect(params, func(pt PacketTransport) PacketTransport {
+		narrow.PacketTransport = pt
+		return narrow
+	})
+	var mtus []int
+	r.step(func() {
+		for {
+			mtu := cli.PathMTU()
+			if len(mtus) == 0 || mtu != mtus[len(mtus) - 1] {
+				mtus = append(mtus, mtu)
+			}
+			if mtu < basePathMTU {
+				return
+			}
+		}
+	})
+	if len(mtus) != 2 || mtus[0] != basePathMTU || mtus[1] > 800 {
+		t.Errorf("path MTU went %v", mtus)
+	}
+	payload := noisePayload(1000)
+	if err := cli.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	r.step(func() {
+		if _, b, err := r.srv.Read(); err != nil || !bytes.Equal(b, payload) {
+			t.Errorf("Read returned %v bytes, %v", len(b), err)
+		}
+	})
+	if mtu := cli.PathMTU(); mtu > 800 {
+		t.Errorf("path MTU %v over path taking 800", mtu)
+	}
+}
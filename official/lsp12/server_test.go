@@ -0,0 +1,148 @@
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Packet for open connection from some other address is dropped, and
+// counted in server stats
+func TestStatsBadSource(t *testing.T) {
+	// One shard, so one reader takes packets in the order sent
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	r := newRig(t, params, nil)
+	cli := r.connect(params, nil)
+	forger, err := r.dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := LspMessage{Type: MsgDATA, ConnId: cli.ConnId(), SeqNum: 1, Payload: []byte("forged")}
+	if _, err := forger.WriteTo(m.appendPacket(nil), r.st.LocalAddr().(PipeAddr).AddrPort); err != nil {
+		t.Fatal(err)
+	}
+	// Genuine message sent after forged one arrives after it
+	if err := cli.Write([]byte("genuine")); err != nil {
+		t.Fatal(err)
+	}
+	if _, b, err := r.srv.Read(); err != nil || string(b) != "genuine" {
+		t.Fatalf("Read returned %q, %v", b, err)
+	}
+	if n := r.srv.Stats().BadSource; n != 1 {
+		t.Errorf("BadSource is %v", n)
+	}
+}
+
+// Writes that client never acknowledges are dropped once their time to
+// live runs out, and counted in connection snapshot
+func TestConnInfoExpired(t *testing.T) {
+	params := &LspParams{EpochLimit: 10, EpochMilliseconds: 100, ServerShards: 1, MessageTTL: 1}
+	r := newRig(t, params, nil)
+	// Client sends connection request, then goes silent
+	cli := r.connect(params, mute(1))
+	for _, s := range []string{"pending", "queued"} {
+		if err := r.srv.Write(cli.ConnId(), []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.epochs(2)
+	conns := r.srv.Connections()
+	if len(conns) != 1 || conns[0].Expired != 2 || conns[0].Queued != 0 {
+		t.Errorf("connections %+v", conns)
+	}
+}
+
+// Drain with no deadline removes one set by an earlier call
+func TestDrainCancelDeadline(t *testing.T) {
+	params := &LspParams{EpochLimit: 10, EpochMilliseconds: 100, ServerShards: 2}
+	r := newRig(t, params, nil)
+	cli := r.connect(params, nil)
+	r.srv.Drain(2)
+	drained := r.srv.Drain(0)
+	r.epochs(5)
+	if conns := r.srv.Connections(); len(conns) != 1 {
+		t.Errorf("connections %+v", conns)
+	}
+	select {
+	case <-drained:
+		t.Errorf("drained with client still connected")
+	default:
+	}
+	r.closeClient(cli)
+	r.step(func() { <-drained })
+}
+
+// Unix datagram server forgets client's name once connection is gone
+func TestUnixgramForgetsPeer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "srv.sock")
+	st, err := ListenUnixgramTransport(path)
+	if err != nil {
+		t.Skip(err)
+	}
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	r := newRigOver(t, params, st, func() (PacketTransport, error) {
+		return DialUnixgramTransport(path)
+	})
+	cli := r.connect(params, nil)
+	peers := st.(*unixgramTransport).peers
+	if n := peers.owned(); n != 1 {
+		t.Fatalf("%v peers while connected", n)
+	}
+	// Draining server signals once connection is gone
+	drained := r.srv.Drain(0)
+	r.srv.CloseConn(cli.ConnId())
+	<-drained
+	if n := peers.owned(); n != 0 {
+		t.Errorf("%v peers after connection closed", n)
+	}
+}
+
+// Connection request is refused, and counted, once shard has handed
+// out every ID
+func TestOutOfIds(t *testing.T) {
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	r := newRig(t, params, nil)
+	sh := r.srv.shards[0]
+	taken := &lspConn{}
+	sh.query(func() {
+		for id := 1; id < 1 << 16; id++ {
+			sh.connById[uint16(id)] = taken
+		}
+	})
+	if _, err := r.dial(params, nil); !errors.Is(err, lsplog.ErrConnectionRefused) {
+		t.Errorf("connecting returned %v", err)
+	}
+	if n := r.srv.Stats().OutOfIds; n != 1 {
+		t.Errorf("OutOfIds is %v", n)
+	}
+	sh.query(func() { clear(sh.connById) })
+}
+
+// Read reports why connection ended: timeout when client goes silent,
+// or whatever other reason ended it
+func TestReadCloseReason(t *testing.T) {
+	params := &LspParams{EpochLimit: 3, EpochMilliseconds: 100, ServerShards: 1}
+	r := newRig(t, params, nil)
+	// Client sends connection request, then goes silent
+	silent := r.connect(params, mute(1))
+	r.epochs(params.EpochLimit + 1)
+	id, _, err := r.srv.Read()
+	var le lsplog.LspErr
+	if id != silent.ConnId() || !errors.Is(err, lsplog.ErrConnectionLost) ||
+		!errors.Is(err, lsplog.ErrTimeout) || !errors.As(err, &le) || le.ConnId != id {
+		t.Errorf("silent client: Read returned %v, %v", id, err)
+	}
+	cli := r.connect(params, nil)
+	reason := errors.New("reset by test")
+	sh := r.srv.shardForId(cli.ConnId())
+	sh.query(func() {
+		con := sh.connById[cli.ConnId()]
+		con.closeErr = lsplog.ConnectionLost(con.connId, reason)
+		sh.writeDone(con)
+	})
+	id, _, err = r.srv.Read()
+	if id != cli.ConnId() || !errors.Is(err, reason) || errors.Is(err, lsplog.ErrTimeout) {
+		t.Errorf("Read returned %v, %v", id, err)
+	}
+}
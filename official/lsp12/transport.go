@@ -0,0 +1,182 @@
+// Packet transports.  LSP only needs to send and receive datagrams, so
+// client and server run over anything that can do that.
+// Peers are identified by netip.AddrPort, which can be compared and
+// used as a map key without allocating.  Transports that don't use IP
+// give each peer a stable synthetic address instead
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"P3-f12/official/lspnet"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// UDP
+
+type udpTransport struct {
+	conn *lspnet.UDPConn
+	connected bool // Dialed to single peer
+}
+
+// Server transport over UDP.  See NewLspServerAddr for arguments
+func ListenUDPTransport(network, address string) (PacketTransport, error) {
+	addr, err := lspnet.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn}, nil
+}
+
+// Client transport over UDP, connected to server at address
+func DialUDPTransport(network, address string) (PacketTransport, error) {
+	addr, err := lspnet.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.DialUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn, connected: true}, nil
+}
+
+func (t *udpTransport) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	return t.conn.ReadFromUDPAddrPort(b)
+}
+
+func (t *udpTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	if t.connected {
+		return t.conn.Write(b)
+	}
+	return t.conn.WriteToUDPAddrPort(b, addr)
+}
+
+func (t *udpTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// What socket error seen while connecting says about server at addr,
+// or nil if it says nothing.  Hosts with nobody listening answer UDP
+// with an ICMP message, which connected sockets report as refused
+func dialError(addr string, err error) error {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return lsplog.ConnectionRefused("Nothing listening at " + addr)
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETDOWN):
+		return lsplog.Unreachable(addr, err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Synthetic addresses
+
+// Hands out addresses from a private IPv6 range, one per name.
+// Any sender gets one, so addresses not owned by a connection are
+// kept in two generations: once the fresh one fills, the stale one is
+// freed and the fresh one takes its place
+type addrTable struct {
+	lock sync.Mutex
+	byName map[string] netip.AddrPort
+	names map[netip.AddrPort] string
+	fresh, stale map[netip.AddrPort] bool // Not owned by a connection
+	next uint32
+}
+
+// Addresses allowed in each generation of unowned ones
+const maxUnowned = 1024
+
+func newAddrTable() *addrTable {
+	return &addrTable{
+		byName: make(map[string] netip.AddrPort),
+		names: make(map[netip.AddrPort] string),
+		fresh: make(map[netip.AddrPort] bool),
+		stale: make(map[netip.AddrPort] bool),
+	}
+}
+
+// Address for name, allocating one if needed
+func (at *addrTable) lookup(name string) netip.AddrPort {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	if ap, ok := at.byName[name]; ok {
+		return ap
+	}
+	at.next++
+	ap := syntheticAddr(at.next)
+	at.byName[name] = ap
+	at.names[ap] = name
+	at.fresh[ap] = true
+	if len(at.fresh) >= maxUnowned {
+		for old := range at.stale {
+			delete(at.byName, at.names[old])
+			delete(at.names, old)
+		}
+		at.stale, at.fresh = at.fresh, make(map[netip.AddrPort] bool)
+	}
+	return ap
+}
+
+// Keep address until removed, now that connection owns it
+func (at *addrTable) own(ap netip.AddrPort) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	delete(at.fresh, ap)
+	delete(at.stale, ap)
+}
+
+// Name that address was allocated for
+func (at *addrTable) name(ap netip.AddrPort) (string, bool) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	name, ok := at.names[ap]
+	return name, ok
+}
+
+// How many addresses are owned by connections
+func (at *addrTable) owned() int {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	return len(at.names) - len(at.fresh) - len(at.stale)
+}
+
+// Free address.  A later packet from the same name gets a new one
+func (at *addrTable) remove(ap netip.AddrPort) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+	if name, ok := at.names[ap]; ok {
+		delete(at.names, ap)
+		delete(at.byName, name)
+		delete(at.fresh, ap)
+		delete(at.stale, ap)
+	}
+}
+
+// Implemented by server transports that keep state for each peer.
+// Server calls own once it accepts peer's connection, and forget once
+// it has deleted it
+type peerTracker interface {
+	own(addr netip.AddrPort)
+	forget(addr netip.AddrPort)
+}
+
+// Address number n in fd00:6c73:70::/48
+func syntheticAddr(n uint32) netip.AddrPort {
+	a := [16]byte{0xfd, 0x00, 0x6c, 0x73, 0x00, 0x70}
+	a[12], a[13], a[14], a[15] = byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)
+	return netip.AddrPortFrom(netip.AddrFrom16(a), 1)
+}
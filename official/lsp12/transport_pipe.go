@@ -0,0 +1,132 @@
+// In-memory transport, for running client and server inside one process
+// without touching real sockets
+package lsp12
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Network of in-memory endpoints.  Packets are copied and queued.  As
+// with UDP, they are dropped when the queue is full or nobody is
+// listening at the destination
+type PipeNetwork struct {
+	lock sync.Mutex
+	endpoints map[netip.AddrPort] *pipeEndpoint
+	next uint32
+}
+
+// Address of endpoint on PipeNetwork
+type PipeAddr struct {
+	netip.AddrPort
+}
+
+func (a PipeAddr) Network() string {
+	return "pipe"
+}
+
+type pipePacket struct {
+	data []byte
+	from netip.AddrPort
+}
+
+type pipeEndpoint struct {
+	pn *PipeNetwork
+	addr netip.AddrPort
+	peer netip.AddrPort // Set for connected endpoint
+	connected bool
+	inbox chan pipePacket
+	done chan bool // Closed when endpoint closed
+	closeOnce sync.Once
+}
+
+// Packets queued at each endpoint before dropping
+const pipeQueueSize = 256
+
+func NewPipeNetwork() *PipeNetwork {
+	return &PipeNetwork{endpoints: make(map[netip.AddrPort] *pipeEndpoint)}
+}
+
+// Server transport with a fresh address, which LocalAddr reports
+func (pn *PipeNetwork) Listen() PacketTransport {
+	return pn.newEndpoint()
+}
+
+// Client transport connected to server at addr
+func (pn *PipeNetwork) Dial(addr net.Addr) (PacketTransport, error) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	ep := pn.newEndpoint()
+	ep.peer = ap
+	ep.connected = true
+	return ep, nil
+}
+
+func (pn *PipeNetwork) newEndpoint() *pipeEndpoint {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	pn.next++
+	ep := &pipeEndpoint{
+		pn: pn,
+		addr: syntheticAddr(pn.next),
+		inbox: make(chan pipePacket, pipeQueueSize),
+		done: make(chan bool),
+	}
+	pn.endpoints[ep.addr] = ep
+	return ep
+}
+
+func (pn *PipeNetwork) endpoint(addr netip.AddrPort) *pipeEndpoint {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	return pn.endpoints[addr]
+}
+
+func (ep *pipeEndpoint) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	select {
+	case p := <- ep.inbox:
+		return copy(b, p.data), p.from, nil
+	case <- ep.done:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
+
+func (ep *pipeEndpoint) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	select {
+	case <- ep.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if ep.connected {
+		addr = ep.peer
+	}
+	dst := ep.pn.endpoint(addr)
+	if dst == nil {
+		// Nobody there.  Lost, as UDP would be
+		return len(b), nil
+	}
+	p := pipePacket{data: append([]byte(nil), b...), from: ep.addr}
+	select {
+	case dst.inbox <- p:
+	default:
+		// Queue full.  Drop
+	}
+	return len(b), nil
+}
+
+func (ep *pipeEndpoint) LocalAddr() net.Addr {
+	return PipeAddr{ep.addr}
+}
+
+func (ep *pipeEndpoint) Close() error {
+	ep.closeOnce.Do(func() {
+		close(ep.done)
+		ep.pn.lock.Lock()
+		delete(ep.pn.endpoints, ep.addr)
+		ep.pn.lock.Unlock()
+	})
+	return nil
+}
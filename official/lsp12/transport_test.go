@@ -0,0 +1,49 @@
+package lsp12
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Senders that never get a connection are freed a generation later,
+// while addresses owned by connections stay
+func TestAddrTableUnowned(t *testing.T) {
+	at := newAddrTable()
+	owner := at.lookup("owner")
+	at.own(owner)
+	first := at.lookup("sender0")
+	for i := 1; i < 3 * maxUnowned; i++ {
+		at.lookup(fmt.Sprint("sender", i))
+	}
+	if n := len(at.names); n > 2 * maxUnowned + 1 {
+		t.Errorf("%v addresses after flood", n)
+	}
+	if _, ok := at.name(first); ok {
+		t.Errorf("oldest unowned address kept")
+	}
+	if name, ok := at.name(owner); !ok || name != "owner" {
+		t.Errorf("owned address lost")
+	}
+	if at.lookup("owner") != owner {
+		t.Errorf("owner given new address")
+	}
+	at.remove(owner)
+	if n := at.owned(); n != 0 {
+		t.Errorf("%v owned after remove", n)
+	}
+}
+
+// Recent sender keeps its address, so that a reply can reach it
+func TestAddrTableStable(t *testing.T) {
+	at := newAddrTable()
+	a := at.lookup("a")
+	for i := 0; i < maxUnowned / 2; i++ {
+		at.lookup(fmt.Sprint("sender", i))
+	}
+	if at.lookup("a") != a {
+		t.Errorf("recent sender given new address")
+	}
+	if name, ok := at.name(a); !ok || name != "a" {
+		t.Errorf("name of recent sender lost")
+	}
+}
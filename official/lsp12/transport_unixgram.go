@@ -0,0 +1,103 @@
+// Unix datagram socket transport, for LSP between processes on one host
+package lsp12
+
+import (
+	"P3-f12/official/lsplog"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+type unixgramTransport struct {
+	conn *net.UnixConn
+	path string // Socket file to remove on close
+	peers *addrTable // Server only.  Synthetic address for each client
+	peer netip.AddrPort // Client only.  Synthetic address for server
+}
+
+// Distinguishes client sockets made by this process
+var unixgramCount atomic.Uint32
+
+// Server transport bound to socket file at path.  A stale socket
+// left there is removed first
+func ListenUnixgramTransport(path string) (PacketTransport, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode() & os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &unixgramTransport{conn: conn, path: path, peers: newAddrTable()}, nil
+}
+
+// Client transport connected to server socket at path.  Server needs
+// a name to reply to, so client binds its own socket in the
+// temporary directory
+func DialUnixgramTransport(path string) (PacketTransport, error) {
+	local := filepath.Join(os.TempDir(),
+		fmt.Sprintf("lsp-%d-%d.sock", os.Getpid(), unixgramCount.Add(1)))
+	os.Remove(local)
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &unixgramTransport{conn: conn, path: local, peer: syntheticAddr(1)}, nil
+}
+
+func (t *unixgramTransport) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	if t.peers == nil {
+		n, err := t.conn.Read(b)
+		return n, t.peer, err
+	}
+	for {
+		n, ua, err := t.conn.ReadFromUnix(b)
+		if err != nil {
+			return n, netip.AddrPort{}, err
+		}
+		if ua == nil || ua.Name == "" {
+			// Unbound sender.  No way to reply
+			lsplog.Vlogf(5, "Unixgram: dropping packet from unnamed socket\n")
+			continue
+		}
+		return n, t.peers.lookup(ua.Name), nil
+	}
+}
+
+func (t *unixgramTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	if t.peers == nil {
+		return t.conn.Write(b)
+	}
+	name, ok := t.peers.name(addr)
+	if !ok {
+		return 0, &net.AddrError{Err: "unknown unixgram peer", Addr: addr.String()}
+	}
+	return t.conn.WriteToUnix(b, &net.UnixAddr{Name: name, Net: "unixgram"})
+}
+
+func (t *unixgramTransport) own(addr netip.AddrPort) {
+	if t.peers != nil {
+		t.peers.own(addr)
+	}
+}
+
+func (t *unixgramTransport) forget(addr netip.AddrPort) {
+	if t.peers != nil {
+		t.peers.remove(addr)
+	}
+}
+
+func (t *unixgramTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *unixgramTransport) Close() error {
+	err := t.conn.Close()
+	os.Remove(t.path)
+	return err
+}
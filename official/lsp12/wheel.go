@@ -0,0 +1,141 @@
+// Hierarchical timer wheel, used by the server to schedule per-connection
+// timers.  Time is measured in ticks (epochs).  Advancing the wheel by one
+// tick only touches the timers that are due, plus an occasional cascade
+// of timers from a coarser level, so idle connections cost nothing.
+package lsp12
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits // Slots per level
+	wheelMask   = wheelSize - 1
+	wheelLevels = 4 // Covers 2^24 ticks.  Later timers are parked and recascaded
+)
+
+// Single timer.  Callback runs on the goroutine that advances the wheel
+type wheelTimer struct {
+	when   int64 // Tick at which timer fires
+	fire   func()
+	active bool
+	level  int
+	slot   int
+	prev   *wheelTimer
+	next   *wheelTimer
+}
+
+func newWheelTimer(fire func()) *wheelTimer {
+	return &wheelTimer{fire: fire}
+}
+
+type timerWheel struct {
+	now   int64 // Last tick processed
+	count int   // Number of active timers
+	slots [wheelLevels][wheelSize]*wheelTimer
+	due   *wheelTimer // Timers taken from slot being run, not yet fired
+}
+
+func newTimerWheel(now int64) *timerWheel {
+	return &timerWheel{now: now}
+}
+
+// Arm timer to fire at specified tick, replacing any earlier setting.
+// Ticks that have already passed fire on the next advance
+func (w *timerWheel) schedule(t *wheelTimer, when int64) {
+	if t.active {
+		w.unlink(t)
+	}
+	if when <= w.now {
+		when = w.now + 1
+	}
+	t.when = when
+	w.place(t)
+}
+
+// Disarm timer.  Harmless if timer not active
+func (w *timerWheel) cancel(t *wheelTimer) {
+	if t.active {
+		w.unlink(t)
+	}
+}
+
+// Run all timers due up to and including tick now
+func (w *timerWheel) advance(now int64) {
+	for w.now < now {
+		t := w.now + 1
+		// Pull timers down from coarser levels whose block starts at t
+		for l := 1; l < wheelLevels; l++ {
+			if t&(1<<uint(wheelBits*l)-1) != 0 {
+				break
+			}
+			w.cascade(l, int((t>>uint(wheelBits*l))&wheelMask))
+		}
+		// Detach slot first, since callbacks may place timers in it.
+		// They may also cancel or reschedule timers still on the list
+		w.due = w.slots[0][t&wheelMask]
+		w.slots[0][t&wheelMask] = nil
+		w.now = t
+		for w.due != nil {
+			tm := w.due
+			w.unlink(tm)
+			tm.fire()
+		}
+	}
+}
+
+// Reinsert all timers in a slot relative to the current time
+func (w *timerWheel) cascade(level, slot int) {
+	tm := w.slots[level][slot]
+	w.slots[level][slot] = nil
+	for tm != nil {
+		next := tm.next
+		tm.prev, tm.next = nil, nil
+		w.count--
+		w.place(tm)
+		tm = next
+	}
+}
+
+// Insert timer into the slot for its expiration time
+func (w *timerWheel) place(t *wheelTimer) {
+	base := w.now + 1
+	delta := t.when - base
+	l := 0
+	for l < wheelLevels-1 && delta >= 1<<uint(wheelBits*(l+1)) {
+		l++
+	}
+	var slot int
+	if delta >= 1<<uint(wheelBits*wheelLevels) {
+		// Beyond range.  Park in furthest slot and recascade from there
+		slot = int(((base >> uint(wheelBits*l)) - 1) & wheelMask)
+	} else {
+		slot = int((t.when >> uint(wheelBits*l)) & wheelMask)
+	}
+	t.level = l
+	t.slot = slot
+	t.prev = nil
+	t.next = w.slots[l][slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[l][slot] = t
+	t.active = true
+	w.count++
+}
+
+// Remove timer from its slot
+func (w *timerWheel) unlink(t *wheelTimer) {
+	if t.prev == nil {
+		if w.due == t {
+			w.due = t.next
+		} else {
+			w.slots[t.level][t.slot] = t.next
+		}
+	} else {
+		t.prev.next = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next = nil, nil
+	t.active = false
+	w.count--
+}
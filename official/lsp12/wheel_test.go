@@ -0,0 +1,67 @@
+package lsp12
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Timers due on same tick, where first callback cancels one and
+// reschedules another
+func TestWheelChangeFromCallback(t *testing.T) {
+	w := newTimerWheel(0)
+	var fired []string
+	var a, b, c, d *wheelTimer
+	a = newWheelTimer(func() {
+		fired = append(fired, "a")
+		w.cancel(b)
+		w.schedule(c, w.now+2)
+	})
+	b = newWheelTimer(func() { fired = append(fired, "b") })
+	c = newWheelTimer(func() { fired = append(fired, "c") })
+	d = newWheelTimer(func() { fired = append(fired, "d") })
+	// Placed at head, so a runs first
+	for _, tm := range []*wheelTimer{d, c, b, a} {
+		w.schedule(tm, 5)
+	}
+	w.advance(5)
+	if want := []string{"a", "d"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v at tick 5, want %v", fired, want)
+	}
+	if b.active || !c.active || d.active || w.count != 1 {
+		t.Fatalf("active b=%v c=%v d=%v count=%v", b.active, c.active, d.active, w.count)
+	}
+	w.advance(7)
+	if want := []string{"a", "d", "c"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v at tick 7, want %v", fired, want)
+	}
+	if c.active || w.count != 0 {
+		t.Fatalf("active c=%v count=%v", c.active, w.count)
+	}
+}
+
+// Callback placing a timer a full turn of level 0 ahead, which lands in
+// the slot being run
+func TestWheelScheduleSameSlot(t *testing.T) {
+	w := newTimerWheel(0)
+	n := 0
+	var a *wheelTimer
+	a = newWheelTimer(func() {
+		n++
+		if n == 1 {
+			w.schedule(a, w.now+wheelSize)
+		}
+	})
+	w.schedule(a, 1)
+	w.advance(1)
+	if n != 1 || !a.active {
+		t.Fatalf("fired %v times, active %v", n, a.active)
+	}
+	w.advance(wheelSize)
+	if n != 1 {
+		t.Fatalf("fired %v times before due", n)
+	}
+	w.advance(wheelSize + 1)
+	if n != 2 || a.active || w.count != 0 {
+		t.Fatalf("fired %v times, active %v, count %v", n, a.active, w.count)
+	}
+}
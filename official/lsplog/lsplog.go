@@ -3,8 +3,9 @@
 package lsplog
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"strings"
 )
 
 
@@ -29,6 +30,12 @@ func SetVerbose(level int) {
 // 5: All communications
 // 6: Everything
 
+// Report whether messages at this level are logged.  Per-packet code
+// uses this to avoid formatting arguments that will never be printed
+func Enabled(level int) bool {
+	return level <= verbosity
+}
+
 // Log result if verbosity level high enough
 func Vlogf(level int, format string, v ...interface{}) {
 	if level <= verbosity {
@@ -56,16 +63,47 @@ func CheckFatal(err error) {
 ////////////////////////////////////////////////////////////////////////////////
 // Error handling
 
+// Sentinel errors.  Errors returned by LSP calls wrap one of these,
+// so callers can classify them with errors.Is
+var (
+	ErrConnectionClosed  = errors.New("connection closed")
+	ErrConnectionLost    = errors.New("connection lost")
+	ErrTimeout           = errors.New("timeout")
+	ErrServerClosed      = errors.New("server closed")
+	ErrUnknownConnection = errors.New("unknown connection")
+	ErrPayloadTooLarge   = errors.New("payload too large")
+	ErrExpired           = errors.New("message expired")
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrUnreachable       = errors.New("unreachable")
+	ErrNoRoom            = errors.New("no room on done channel")
+)
+
+// Use errors.As to get at the connection and reason
 type LspErr struct {
-	msg string
+	msg    string
+	Kind   error  // Sentinel classifying error, or nil
+	ConnId uint16 // Connection concerned, or 0 if none
+	Reason error  // Why connection ended, or nil
 }
 
 func (e LspErr) Error() string {
 	return e.msg
 }
 
+// Allows errors.Is to match both kind and reason
+func (e LspErr) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Reason != nil {
+		errs = append(errs, e.Reason)
+	}
+	return errs
+}
+
 func MakeErr(msg string) LspErr {
-	return LspErr{msg}
+	return LspErr{msg: msg}
 }
 
 // Common error types
@@ -73,11 +111,69 @@ func NotImplemented(name string) LspErr {
 	return MakeErr("Not implemented: " + name)
 }
 
-func ConnectionClosed() LspErr {
-	return MakeErr("Connection closed")
+// Connection ended by application
+func ConnectionClosed(id uint16) LspErr {
+	return LspErr{msg: fmt.Sprintf("Connection %v closed", id),
+		Kind: ErrConnectionClosed, ConnId: id}
+}
+
+// Connection ended without application asking
+func ConnectionLost(id uint16, reason error) LspErr {
+	return LspErr{msg: fmt.Sprintf("Connection %v lost: %v", id, reason),
+		Kind: ErrConnectionLost, ConnId: id, Reason: reason}
+}
+
+// Gave up waiting for other end
+func Timeout(what string) LspErr {
+	return LspErr{msg: what + ": timeout", Kind: ErrTimeout}
+}
+
+func UnknownConnection(id uint16) LspErr {
+	return LspErr{msg: fmt.Sprintf("Unknown connection %v", id),
+		Kind: ErrUnknownConnection, ConnId: id}
+}
+
+func ServerClosed() LspErr {
+	return LspErr{msg: "Server closed", Kind: ErrServerClosed}
+}
+
+func PayloadTooLarge(size, max int) LspErr {
+	return LspErr{msg: fmt.Sprintf("Payload of %v bytes exceeds limit of %v", size, max),
+		Kind: ErrPayloadTooLarge}
+}
+
+// Server turned down connection request, for reason if given
+func ConnectionRefused(reason string) LspErr {
+	if reason == "" {
+		return LspErr{msg: "Connection refused", Kind: ErrConnectionRefused}
+	}
+	return LspErr{msg: "Connection refused: " + reason,
+		Kind: ErrConnectionRefused, Reason: errors.New(reason)}
+}
+
+// Couldn't get packets to host at addr
+func Unreachable(addr string, reason error) LspErr {
+	return LspErr{msg: fmt.Sprintf("%v unreachable: %v", addr, reason),
+		Kind: ErrUnreachable, Reason: reason}
+}
+
+// Message dropped because it wasn't acknowledged in time
+func Expired(id uint16) LspErr {
+	return LspErr{msg: fmt.Sprintf("Message on connection %v expired", id),
+		Kind: ErrExpired, ConnId: id}
+}
+
+// Done channel passed with write can't take another outcome.  Room
+// is counted for every outcome not yet reported
+func NoRoom(capacity int) LspErr {
+	return LspErr{msg: fmt.Sprintf("Done channel with room for %v has none left", capacity),
+		Kind: ErrNoRoom}
 }
 
+// Has connection ended, for whatever reason?
 func ErrClosed(err error) bool {
-	return err != nil && strings.EqualFold(err.Error(), "Connection closed")
+	return errors.Is(err, ErrConnectionClosed) ||
+		errors.Is(err, ErrConnectionLost) ||
+		errors.Is(err, ErrServerClosed)
 }
 
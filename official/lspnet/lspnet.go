@@ -7,30 +7,34 @@ package lspnet
 
 import (
 	"net"
+	"net/netip"
+	"os"
 	"P3-f12/official/lsplog"
 	"math/rand"
+	"sync/atomic"
 )
 
 // Useful parameters
 
-var readDropPercent int = 0  // Fraction of packets to drop when reading
-var writeDropPercent int = 0 // Fraction of packets to drop when writing
+// Can be changed while connections are running, so accessed atomically
+var readDropPercent atomic.Int32  // Fraction of packets to drop when reading
+var writeDropPercent atomic.Int32 // Fraction of packets to drop when writing
 
 // Special functions to set network parameters
 
 func SetReadDropPercent(p int) {
 	if p < 0 || p > 100 {
-		readDropPercent = 0
+		readDropPercent.Store(0)
 	} else {
-		readDropPercent = p
+		readDropPercent.Store(int32(p))
 	}
 }
 
 func SetWriteDropPercent(p int) {
 	if p < 0 || p > 100 {
-		writeDropPercent = 0
+		writeDropPercent.Store(0)
 	} else {
-		writeDropPercent = p
+		writeDropPercent.Store(int32(p))
 	}
 }
 
@@ -47,24 +51,29 @@ type UDPConn struct {
 func ResolveUDPAddr(ntwk, addr string) (*UDPAddr, error) {
 	a, err := net.ResolveUDPAddr(ntwk, addr)
 	if err == nil {
-		return &UDPAddr{a.IP, a.Port}, err
+		return &UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}, err
 	}
 	return nil, err
 }
 
 func (addr *UDPAddr) String() string {
-	naddr := &net.UDPAddr{addr.IP, addr.Port}
+	naddr := (*net.UDPAddr)(addr)
 	return naddr.String()
 }
 
+// Comparable form of address.  Can be used as map key
+func (addr *UDPAddr) AddrPort() netip.AddrPort {
+	return (*net.UDPAddr)(addr).AddrPort()
+}
+
 func DialUDP(ntwk string, laddr, raddr *UDPAddr) (*UDPConn, error) {
 	var nladdr *net.UDPAddr = nil
 	if laddr != nil {
-		nladdr = &net.UDPAddr{laddr.IP, laddr.Port}
+		nladdr = (*net.UDPAddr)(laddr)
 	}
 	var nraddr *net.UDPAddr = nil
 	if raddr != nil {
-		nraddr = &net.UDPAddr{raddr.IP, raddr.Port}
+		nraddr = (*net.UDPAddr)(raddr)
 	}
 	ncon, err := net.DialUDP(ntwk, nladdr, nraddr)
 	rcon := &UDPConn{ncon}
@@ -74,45 +83,74 @@ func DialUDP(ntwk string, laddr, raddr *UDPAddr) (*UDPConn, error) {
 func ListenUDP(ntwk string, laddr *UDPAddr) (*UDPConn, error) {
 	var nladdr *net.UDPAddr = nil
 	if laddr != nil {
-		nladdr = &net.UDPAddr{laddr.IP, laddr.Port}
+		nladdr = (*net.UDPAddr)(laddr)
 	}
 	ncon, err := net.ListenUDP(ntwk, nladdr)
 	rcon := &UDPConn{ncon}
 	return rcon, err
 }
 
+// Wrap socket inherited from elsewhere.  File f can be closed afterwards
+func FileUDPConn(f *os.File) (*UDPConn, error) {
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	ncon, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, &net.OpError{Op: "file", Net: "udp", Err: net.UnknownNetworkError(pc.LocalAddr().Network())}
+	}
+	return &UDPConn{ncon}, nil
+}
+
+func (con *UDPConn) LocalAddr() net.Addr {
+	return con.ncon.LocalAddr()
+}
+
+// Duplicate of underlying socket, for passing to another process
+func (con *UDPConn) File() (*os.File, error) {
+	return con.ncon.File()
+}
+
 func (con *UDPConn) ReadFromUDP(b [] byte) (n int, addr *UDPAddr, err error) {
-	var buffer [2000]byte
-	ncon := con.ncon
 	var naddr *net.UDPAddr
-	done := false
-	for !done {
-		n, naddr, err = ncon.ReadFromUDP(buffer[0:])
-		if dropit(readDropPercent) {
-			lsplog.Vlogf(5, "UDP: DROPPING read packet of length %v\n", n)
-		} else {
-			lsplog.Vlogf(6, "UDP: Read packet of length %v\n", n)
-			copy(b, buffer[0:])
-			done = true
-		}
-		if naddr == nil {
-			addr = nil
-		} else {
-			addr = &UDPAddr{naddr.IP, naddr.Port}
-		}
+	n, naddr, err = con.ncon.ReadFromUDP(b)
+	for err == nil && dropit(&readDropPercent) {
+		lsplog.Vlogf(5, "UDP: DROPPING read packet of length %v\n", n)
+		n, naddr, err = con.ncon.ReadFromUDP(b)
+	}
+	if lsplog.Enabled(6) {
+		lsplog.Vlogf(6, "UDP: Read packet of length %v\n", n)
+	}
+	if naddr != nil {
+		addr = (*UDPAddr)(naddr)
+	}
+	return n, addr, err
+}
+
+// Same as ReadFromUDP, but reads directly into b and reports source
+// as a value, so that nothing is allocated per packet
+func (con *UDPConn) ReadFromUDPAddrPort(b [] byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = con.ncon.ReadFromUDPAddrPort(b)
+	for err == nil && dropit(&readDropPercent) {
+		lsplog.Vlogf(5, "UDP: DROPPING read packet of length %v\n", n)
+		n, addr, err = con.ncon.ReadFromUDPAddrPort(b)
 	}
 	return n, addr, err
 }
 	
 func (con *UDPConn) Write(b []byte) (int, error) {
 	ncon := con.ncon
-	if dropit(writeDropPercent) {
+	if dropit(&writeDropPercent) {
 		lsplog.Vlogf(5, "UDP: DROPPING written packet of length %v\n", len(b))
 		// Make it look like write was successful
 		return len(b), nil
 	} else {
 		n, err := ncon.Write(b)
-		lsplog.Vlogf(5, "UDP: Wrote packet of length %v\v", n)
+		if lsplog.Enabled(5) {
+			lsplog.Vlogf(5, "UDP: Wrote packet of length %v\v", n)
+		}
 		return n, err
 	}
 	return 0, nil
@@ -120,24 +158,37 @@ func (con *UDPConn) Write(b []byte) (int, error) {
 
 func (con *UDPConn) WriteToUDP(b []byte, addr *UDPAddr) (int, error) {
 	ncon := con.ncon
-	naddr := &net.UDPAddr{addr.IP, addr.Port}
-	if dropit(writeDropPercent) {
+	naddr := (*net.UDPAddr)(addr)
+	if dropit(&writeDropPercent) {
 		lsplog.Vlogf(5, "UDP: DROPPING written packet of length %v\n", len(b))
 		// Make it look like write was successful
 		return len(b), nil
 	} else {
 		n, err := ncon.WriteToUDP(b, naddr)
-		lsplog.Vlogf(5, "UDP: Wrote packet of length %v", n)
+		if lsplog.Enabled(5) {
+			lsplog.Vlogf(5, "UDP: Wrote packet of length %v", n)
+		}
 		return n, err
 	}
 	return 0, nil
 }
 
+// Same as WriteToUDP, but with destination given as a value
+func (con *UDPConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	if dropit(&writeDropPercent) {
+		lsplog.Vlogf(5, "UDP: DROPPING written packet of length %v\n", len(b))
+		// Make it look like write was successful
+		return len(b), nil
+	}
+	return con.ncon.WriteToUDPAddrPort(b, addr)
+}
+
 func (con *UDPConn) Close() error {
 	ncon := con.ncon
 	return ncon.Close()
 }
 
-func dropit(dropPercent int) bool {
-	return (rand.Intn(100) < dropPercent)
+func dropit(dropPercent *atomic.Int32) bool {
+	p := int(dropPercent.Load())
+	return p > 0 && rand.Intn(100) < p
 }